@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ReconcileResult is the outcome of one agent pass. Drift lists the peer
+// changes the pass found on the interface; they were corrected when Error
+// is empty.
+type ReconcileResult struct {
+	Time     time.Time `json:"time"`
+	Drift    SyncPlan  `json:"drift"`
+	Applied  bool      `json:"applied"`
+	Error    string    `json:"error,omitempty"`
+	Interval string    `json:"interval,omitempty"`
+}
+
+// Reconcile compares the running interface with the enabled peers and
+// re-applies the desired state if they differ; see planSync for what is
+// compared. The firewall is not inspected, so rules flushed by hand come
+// back only with the next drift, sync or up. An interface that is down is
+// reported, not brought up: `vpn down` is a deliberate state.
+func (m *Manager) Reconcile() ReconcileResult {
+	result := ReconcileResult{Time: time.Now().UTC()}
+	plan, err := m.PlanSync()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Drift = plan
+	if plan.Empty() {
+		return result
+	}
+	err = m.sync()
+	m.recordSync("reconcile", err)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Applied = true
+	return result
+}
+
+func (m *Manager) agentStatusPath() string {
+	return filepath.Join(m.cfg.DataDir, "agent.json")
+}
+
+// SaveAgentStatus writes the result of the latest pass for `vpn agent
+// status`. It replaces the file atomically so readers never see half of it.
+func (m *Manager) SaveAgentStatus(result ReconcileResult) error {
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := m.agentStatusPath()
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+var errNoAgentStatus = errors.New("agent has not run yet")
+
+func (m *Manager) AgentStatus() (ReconcileResult, error) {
+	var result ReconcileResult
+	data, err := os.ReadFile(m.agentStatusPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return result, errNoAgentStatus
+	}
+	if err != nil {
+		return result, err
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return result, fmt.Errorf("parse agent status: %w", err)
+	}
+	return result, nil
+}
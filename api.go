@@ -3,44 +3,152 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"log"
 	"net/http"
-	"strings"
+	"strconv"
 	"sync"
+	"time"
 )
 
 type peerView struct {
-	Name      string `json:"name"`
-	PublicKey string `json:"publicKey"`
-	IP        string `json:"ip"`
-	Enabled   bool   `json:"enabled"`
-	Created   string `json:"created"`
+	Name      string           `json:"name"`
+	PublicKey string           `json:"publicKey"`
+	IP        string           `json:"ip"`
+	IP6       string           `json:"ip6,omitempty"`
+	Routes    []string         `json:"routes,omitempty"`
+	Sites     []string         `json:"sites,omitempty"`
+	Mesh      string           `json:"meshEndpoint,omitempty"`
+	Enabled   bool             `json:"enabled"`
+	Created   string           `json:"created"`
+	Runtime   *peerRuntimeView `json:"runtime,omitempty"`
+}
+
+// peerRuntimeView is the live WireGuard state of a peer. It is omitted when
+// the interface is down or the peer isn't loaded into it.
+type peerRuntimeView struct {
+	Online          bool   `json:"online"`
+	LatestHandshake string `json:"latestHandshake,omitempty"`
+	Endpoint        string `json:"endpoint,omitempty"`
+	RxBytes         int64  `json:"rxBytes"`
+	TxBytes         int64  `json:"txBytes"`
+}
+
+type usageView struct {
+	Name         string            `json:"name"`
+	Since        string            `json:"since"`
+	By           string            `json:"by"`
+	Buckets      []usageBucketView `json:"buckets"`
+	TotalRxBytes int64             `json:"totalRxBytes"`
+	TotalTxBytes int64             `json:"totalTxBytes"`
+}
+
+type usageBucketView struct {
+	Start   string `json:"start"`
+	RxBytes int64  `json:"rxBytes"`
+	TxBytes int64  `json:"txBytes"`
 }
 
 type APIServer struct {
-	mgr *Manager
-	mu  sync.Mutex
+	mgr     *Manager
+	mu      sync.Mutex
+	metrics *apiMetrics
 }
 
 func NewAPIServer(mgr *Manager) *APIServer {
-	return &APIServer{mgr: mgr}
+	return &APIServer{mgr: mgr, metrics: newAPIMetrics()}
+}
+
+// newPeerView renders a stored peer with its live state from statuses, if
+// the interface has it.
+func newPeerView(peer *Peer, statuses map[string]PeerStatus, now time.Time) peerView {
+	view := peerView{
+		Name:      peer.Name,
+		PublicKey: peer.PublicKey,
+		IP:        peer.IP(),
+		IP6:       peer.IP6(),
+		Routes:    peer.Routes,
+		Sites:     peer.SiteRoutes,
+		Mesh:      peer.Endpoint,
+		Enabled:   peer.Enabled,
+		Created:   peer.CreatedAt.Format("2006-01-02"),
+	}
+	if st, ok := statuses[peer.PublicKey]; ok {
+		view.Runtime = &peerRuntimeView{
+			Online:   st.Online(now),
+			Endpoint: st.Endpoint,
+			RxBytes:  st.RxBytes,
+			TxBytes:  st.TxBytes,
+		}
+		if !st.LastHandshake.IsZero() {
+			view.Runtime.LatestHandshake = st.LastHandshake.UTC().Format(time.RFC3339)
+		}
+	}
+	return view
 }
 
 func (a *APIServer) HandlePeers(w http.ResponseWriter, r *http.Request) {
-	peers, err := a.mgr.ListPeers()
+	peers, err := a.manager(r).ListPeers()
 	if err != nil {
 		http.Error(w, "Failed to list peers", http.StatusInternalServerError)
 		return
 	}
 
+	statuses, err := a.manager(r).PeerStatuses()
+	if err != nil {
+		log.Printf("live peer status unavailable: %v", err)
+	}
+
+	now := time.Now()
 	var out []peerView
 	for _, peer := range peers {
-		out = append(out, peerView{
-			Name:      peer.Name,
-			PublicKey: peer.PublicKey,
-			IP:        strings.TrimSuffix(peer.AllowedIP, "/32"),
-			Enabled:   peer.Enabled,
-			Created:   peer.CreatedAt.Format("2006-01-02"),
+		out = append(out, newPeerView(&peer, statuses, now))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// HandlePeerUsage serves GET /api/peers/{name}/usage?since=30d&by=day.
+func (a *APIServer) HandlePeerUsage(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	sinceParam := r.URL.Query().Get("since")
+	if sinceParam == "" {
+		sinceParam = "30d"
+	}
+	since, err := parseSince(sinceParam, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	by := r.URL.Query().Get("by")
+	if by == "" {
+		by = usageByDay
+	}
+	if by != usageByDay && by != usageByHour {
+		http.Error(w, "by must be day or hour", http.StatusBadRequest)
+		return
+	}
+
+	buckets, err := a.manager(r).Usage(name, since, by)
+	if err != nil {
+		if errors.Is(err, errPeerNotFound) {
+			http.Error(w, "Peer not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to load usage", http.StatusInternalServerError)
+		return
+	}
+
+	out := usageView{Name: name, Since: since.UTC().Format(time.RFC3339), By: by, Buckets: []usageBucketView{}}
+	for _, b := range buckets {
+		out.Buckets = append(out.Buckets, usageBucketView{
+			Start:   b.Start.Format(time.RFC3339),
+			RxBytes: b.RxBytes,
+			TxBytes: b.TxBytes,
 		})
+		out.TotalRxBytes += b.RxBytes
+		out.TotalTxBytes += b.TxBytes
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -62,21 +170,62 @@ func (a *APIServer) HandleAddPeer(w http.ResponseWriter, r *http.Request) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
-	peer, err := a.mgr.AddPeer(name)
+	routes, err := parseRoutes(r.FormValue("routes"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sites, err := parseRoutes(r.FormValue("site"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts := PeerOptions{
+		PresharedKey: r.FormValue("psk") == "true",
+		PublicKey:    r.FormValue("publicKey"),
+		Routes:       routes,
+		SiteRoutes:   sites,
+		Endpoint:     r.FormValue("endpoint"),
+		Group:        r.FormValue("group"),
+	}
+	peer, result, err := a.manager(r).AddPeer(name, opts)
 	if err != nil {
 		if errors.Is(err, errPeerExists) {
 			http.Error(w, "Peer already exists", http.StatusBadRequest)
 			return
 		}
+		if errors.Is(err, errForbidden) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if errors.Is(err, errGroupNotFound) {
+			http.Error(w, "Group not found", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, errPoolExhausted) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if errors.Is(err, errInvalidPublicKey) || errors.Is(err, errPublicKeyInUse) ||
+			errors.Is(err, errRouteOverlap) || errors.Is(err, errInvalidEndpoint) || errors.Is(err, errInvalidPeerName) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		http.Error(w, "Failed to save peer", http.StatusInternalServerError)
 		return
 	}
+	config, err := a.manager(r).ClientConfig(peer)
+	if err != nil {
+		http.Error(w, "Failed to generate config", http.StatusInternalServerError)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(map[string]string{
-		"status": "ok",
-		"config": a.mgr.ClientConfig(peer),
-	})
+	resp := map[string]any{"status": "ok", "config": config}
+	if result != nil {
+		resp["sync"] = result
+	}
+	_ = json.NewEncoder(w).Encode(resp)
 }
 
 func (a *APIServer) HandleRemovePeer(w http.ResponseWriter, r *http.Request) {
@@ -94,15 +243,236 @@ func (a *APIServer) HandleRemovePeer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := a.mgr.RemovePeer(name); err != nil {
+	result, err := a.manager(r).RemovePeer(name)
+	if err != nil {
 		if errors.Is(err, errPeerNotFound) {
 			http.Error(w, "Peer not found", http.StatusNotFound)
 			return
 		}
+		if errors.Is(err, errForbidden) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
 		http.Error(w, "Failed to delete peer", http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	resp := map[string]any{"status": "ok"}
+	if result != nil {
+		resp["sync"] = result
+	}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (a *APIServer) HandleEnablePeer(w http.ResponseWriter, r *http.Request) {
+	a.setPeerEnabled(w, r, true)
+}
+
+func (a *APIServer) HandleDisablePeer(w http.ResponseWriter, r *http.Request) {
+	a.setPeerEnabled(w, r, false)
+}
+
+func (a *APIServer) setPeerEnabled(w http.ResponseWriter, r *http.Request, enabled bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	name := r.FormValue("name")
+	if name == "" {
+		http.Error(w, "Name required", http.StatusBadRequest)
+		return
+	}
+
+	setEnabled := a.manager(r).DisablePeer
+	if enabled {
+		setEnabled = a.manager(r).EnablePeer
+	}
+	result, err := setEnabled(name)
+	if err != nil {
+		if errors.Is(err, errPeerNotFound) {
+			http.Error(w, "Peer not found", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, errForbidden) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		http.Error(w, "Failed to update peer", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	resp := map[string]any{"status": "ok"}
+	if result != nil {
+		resp["sync"] = result
+	}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// HandleGroups serves GET /api/groups.
+func (a *APIServer) HandleGroups(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	groups, err := a.manager(r).ListGroups()
+	if err != nil {
+		http.Error(w, "Failed to list groups", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(groups)
+}
+
+func (a *APIServer) HandleCreateGroup(w http.ResponseWriter, r *http.Request) {
+	a.updateGroup(w, r, func(group string) error {
+		return a.manager(r).CreateGroup(group)
+	})
+}
+
+func (a *APIServer) HandleDeleteGroup(w http.ResponseWriter, r *http.Request) {
+	a.updateGroup(w, r, func(group string) error {
+		return a.manager(r).DeleteGroup(group)
+	})
+}
+
+func (a *APIServer) HandleAddGroupMember(w http.ResponseWriter, r *http.Request) {
+	a.updateGroup(w, r, func(group string) error {
+		return a.manager(r).AddGroupMember(group, r.FormValue("peer"))
+	})
+}
+
+func (a *APIServer) HandleRemoveGroupMember(w http.ResponseWriter, r *http.Request) {
+	a.updateGroup(w, r, func(group string) error {
+		return a.manager(r).RemoveGroupMember(group, r.FormValue("peer"))
+	})
+}
+
+// updateGroup handles the POST /api/group/* endpoints, which all take the
+// group in the "group" form field.
+func (a *APIServer) updateGroup(w http.ResponseWriter, r *http.Request, update func(group string) error) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	group := r.FormValue("group")
+	if group == "" {
+		http.Error(w, "Group required", http.StatusBadRequest)
+		return
+	}
+
+	if err := update(group); err != nil {
+		switch {
+		case errors.Is(err, errGroupNotFound):
+			http.Error(w, "Group not found", http.StatusNotFound)
+		case errors.Is(err, errPeerNotFound):
+			http.Error(w, "Peer not found", http.StatusNotFound)
+		case errors.Is(err, errGroupExists), errors.Is(err, errInvalidGroupName):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, errForbidden):
+			http.Error(w, err.Error(), http.StatusForbidden)
+		default:
+			http.Error(w, "Failed to update group", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// HandlePolicies serves GET /api/policies, optionally filtered by ?group=.
+func (a *APIServer) HandlePolicies(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	policies, err := a.manager(r).ListPolicies(r.URL.Query().Get("group"))
+	if err != nil {
+		http.Error(w, "Failed to list policies", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(policies)
+}
+
+// HandleAddPolicy takes the group and a target such as "10.20.5.0/24:443"
+// in the "allow" form field.
+func (a *APIServer) HandleAddPolicy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	policy, err := parsePolicyTarget(r.FormValue("allow"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	policy.Group = r.FormValue("group")
+
+	id, err := a.manager(r).AddPolicy(policy)
+	if err != nil {
+		if errors.Is(err, errGroupNotFound) {
+			http.Error(w, "Group not found", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, errForbidden) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		http.Error(w, "Failed to add policy", http.StatusInternalServerError)
+		return
+	}
+	policy.ID = id
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(policy)
+}
+
+func (a *APIServer) HandleRemovePolicy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Policy id required", http.StatusBadRequest)
+		return
+	}
+	if err := a.manager(r).RemovePolicy(id); err != nil {
+		if errors.Is(err, errPolicyNotFound) {
+			http.Error(w, "Policy not found", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, errForbidden) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		http.Error(w, "Failed to remove policy", http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 }
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The v2 API is resource oriented: /api/v2/peers and /api/v2/peers/{name}
+// take and return JSON, and every error is a JSON object with a stable code
+// so clients need not parse messages. The v1 routes stay as they are.
+
+type apiErrorBody struct {
+	Error apiErrorDetail `json:"error"`
+}
+
+type apiErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// peerRequest is the body of POST /api/v2/peers.
+type peerRequest struct {
+	Name         string   `json:"name"`
+	PublicKey    string   `json:"publicKey"`
+	PresharedKey bool     `json:"psk"`
+	Routes       []string `json:"routes"`
+	Sites        []string `json:"sites"`
+	Endpoint     string   `json:"endpoint"`
+	Group        string   `json:"group"`
+}
+
+// peerPatch is the body of PATCH /api/v2/peers/{name}; absent fields are
+// left alone.
+type peerPatch struct {
+	Enabled *bool `json:"enabled"`
+}
+
+type peerCreatedView struct {
+	Peer   peerView    `json:"peer"`
+	Config string      `json:"config"`
+	Sync   *SyncResult `json:"sync,omitempty"`
+}
+
+// peerUpdatedView is the peer with the outcome of auto_sync alongside its
+// fields.
+type peerUpdatedView struct {
+	peerView
+	Sync *SyncResult `json:"sync,omitempty"`
+}
+
+type peerDeletedView struct {
+	Name string      `json:"name"`
+	Sync *SyncResult `json:"sync,omitempty"`
+}
+
+// errorCode maps an error from Manager to an HTTP status and error code.
+func errorCode(err error) (int, string) {
+	switch {
+	case errors.Is(err, errPeerNotFound):
+		return http.StatusNotFound, "peer_not_found"
+	case errors.Is(err, errGroupNotFound):
+		return http.StatusNotFound, "group_not_found"
+	case errors.Is(err, errPeerExists):
+		return http.StatusConflict, "peer_exists"
+	case errors.Is(err, errPublicKeyInUse):
+		return http.StatusConflict, "public_key_in_use"
+	case errors.Is(err, errRouteOverlap):
+		return http.StatusConflict, "route_overlap"
+	case errors.Is(err, errPoolExhausted):
+		return http.StatusConflict, "pool_exhausted"
+	case errors.Is(err, errInvalidPeerName):
+		return http.StatusBadRequest, "invalid_name"
+	case errors.Is(err, errInvalidPublicKey):
+		return http.StatusBadRequest, "invalid_public_key"
+	case errors.Is(err, errInvalidRoute):
+		return http.StatusBadRequest, "invalid_route"
+	case errors.Is(err, errInvalidEndpoint):
+		return http.StatusBadRequest, "invalid_endpoint"
+	case errors.Is(err, errForbidden):
+		return http.StatusForbidden, "forbidden"
+	default:
+		return http.StatusInternalServerError, "internal"
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, apiErrorBody{Error: apiErrorDetail{Code: code, Message: message}})
+}
+
+// writeManagerError reports err from Manager. Internal errors are logged
+// and not shown to the client.
+func writeManagerError(w http.ResponseWriter, err error) {
+	status, code := errorCode(err)
+	message := err.Error()
+	if status == http.StatusInternalServerError {
+		log.Printf("api: %v", err)
+		message = "internal error"
+	}
+	writeAPIError(w, status, code, message)
+}
+
+// writeHTTPError reports an error found before a handler runs, such as a
+// missing token: as JSON on v2 routes, as plain text on v1.
+func writeHTTPError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	if strings.HasPrefix(r.URL.Path, "/api/v2/") {
+		writeAPIError(w, status, code, message)
+		return
+	}
+	http.Error(w, message, status)
+}
+
+// decodeJSON reads a JSON body, rejecting unknown fields so that typos do
+// not pass silently.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_json", err.Error())
+		return false
+	}
+	return true
+}
+
+// HandleV2ListPeers serves GET /api/v2/peers.
+func (a *APIServer) HandleV2ListPeers(w http.ResponseWriter, r *http.Request) {
+	mgr := a.manager(r)
+	peers, err := mgr.ListPeers()
+	if err != nil {
+		writeManagerError(w, err)
+		return
+	}
+	statuses, err := mgr.PeerStatuses()
+	if err != nil {
+		log.Printf("live peer status unavailable: %v", err)
+	}
+
+	now := time.Now()
+	out := []peerView{}
+	for _, peer := range peers {
+		out = append(out, newPeerView(&peer, statuses, now))
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// HandleV2GetPeer serves GET /api/v2/peers/{name}.
+func (a *APIServer) HandleV2GetPeer(w http.ResponseWriter, r *http.Request) {
+	mgr := a.manager(r)
+	peer, err := mgr.GetPeer(r.PathValue("name"))
+	if err != nil {
+		writeManagerError(w, err)
+		return
+	}
+	statuses, err := mgr.PeerStatuses()
+	if err != nil {
+		log.Printf("live peer status unavailable: %v", err)
+	}
+	writeJSON(w, http.StatusOK, newPeerView(peer, statuses, time.Now()))
+}
+
+// HandleV2CreatePeer serves POST /api/v2/peers.
+func (a *APIServer) HandleV2CreatePeer(w http.ResponseWriter, r *http.Request) {
+	var req peerRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if req.Name == "" {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request", "name is required")
+		return
+	}
+	routes, err := parseRoutes(strings.Join(req.Routes, ","))
+	if err != nil {
+		writeManagerError(w, err)
+		return
+	}
+	sites, err := parseRoutes(strings.Join(req.Sites, ","))
+	if err != nil {
+		writeManagerError(w, err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	mgr := a.manager(r)
+	peer, result, err := mgr.AddPeer(req.Name, PeerOptions{
+		PresharedKey: req.PresharedKey,
+		PublicKey:    req.PublicKey,
+		Routes:       routes,
+		SiteRoutes:   sites,
+		Endpoint:     req.Endpoint,
+		Group:        req.Group,
+	})
+	if err != nil {
+		writeManagerError(w, err)
+		return
+	}
+	config, err := mgr.ClientConfig(peer)
+	if err != nil {
+		writeManagerError(w, fmt.Errorf("generate config: %w", err))
+		return
+	}
+
+	w.Header().Set("Location", "/api/v2/peers/"+peer.Name)
+	writeJSON(w, http.StatusCreated, peerCreatedView{
+		Peer:   newPeerView(peer, nil, time.Now()),
+		Config: config,
+		Sync:   result,
+	})
+}
+
+// HandleV2UpdatePeer serves PATCH /api/v2/peers/{name}.
+func (a *APIServer) HandleV2UpdatePeer(w http.ResponseWriter, r *http.Request) {
+	var patch peerPatch
+	if !decodeJSON(w, r, &patch) {
+		return
+	}
+	if patch.Enabled == nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request", "nothing to update: set enabled")
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	mgr := a.manager(r)
+	name := r.PathValue("name")
+	setEnabled := mgr.DisablePeer
+	if *patch.Enabled {
+		setEnabled = mgr.EnablePeer
+	}
+	result, err := setEnabled(name)
+	if err != nil {
+		writeManagerError(w, err)
+		return
+	}
+	peer, err := mgr.GetPeer(name)
+	if err != nil {
+		writeManagerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, peerUpdatedView{peerView: newPeerView(peer, nil, time.Now()), Sync: result})
+}
+
+// HandleV2DeletePeer serves DELETE /api/v2/peers/{name}.
+func (a *APIServer) HandleV2DeletePeer(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	name := r.PathValue("name")
+	result, err := a.manager(r).RemovePeer(name)
+	if err != nil {
+		writeManagerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, peerDeletedView{Name: name, Sync: result})
+}
+
+// V2MethodNotAllowed answers requests to a v2 resource with a method it
+// does not support.
+func V2MethodNotAllowed(allow string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", allow)
+		writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", r.Method+" is not supported; use "+allow)
+	}
+}
+
+// V2NotFound answers requests to unknown v2 paths.
+func V2NotFound(w http.ResponseWriter, r *http.Request) {
+	writeAPIError(w, http.StatusNotFound, "not_found", "no such resource: "+r.URL.Path)
+}
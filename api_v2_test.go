@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestV2CreatePeerErrors(t *testing.T) {
+	// A /30 holds the server and one peer.
+	mgr, _ := newTestManager(t, &Config{Interface: "wg0", Address: "10.0.0.1/30"})
+	api := NewAPIServer(mgr)
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantCode   string
+	}{
+		{"created", `{"name": "alice"}`, http.StatusCreated, ""},
+		{"exists", `{"name": "alice"}`, http.StatusConflict, "peer_exists"},
+		{"pool exhausted", `{"name": "bob"}`, http.StatusConflict, "pool_exhausted"},
+		{"unknown group", `{"name": "carol", "group": "nope"}`, http.StatusNotFound, "group_not_found"},
+		{"invalid name", `{"name": "../etc"}`, http.StatusBadRequest, "invalid_name"},
+		{"missing name", `{}`, http.StatusBadRequest, "invalid_request"},
+		{"unknown field", `{"name": "dave", "color": "red"}`, http.StatusBadRequest, "invalid_json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/v2/peers", strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+			api.HandleV2CreatePeer(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantCode == "" {
+				return
+			}
+			var body apiErrorBody
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Error.Code != tt.wantCode {
+				t.Errorf("code = %q, want %q", body.Error.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestV2PeerErrors(t *testing.T) {
+	mgr, _ := newTestManager(t, &Config{Interface: "wg0", Address: "10.0.0.1/24"})
+	if err := mgr.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := mgr.AddPeer("alice", PeerOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	api := NewAPIServer(mgr)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v2/peers/{name}", api.HandleV2GetPeer)
+	mux.HandleFunc("PATCH /api/v2/peers/{name}", api.HandleV2UpdatePeer)
+	mux.HandleFunc("DELETE /api/v2/peers/{name}", api.HandleV2DeletePeer)
+	mux.HandleFunc("/api/v2/peers/{name}", V2MethodNotAllowed("GET, PATCH, DELETE"))
+	mux.HandleFunc("/api/v2/", V2NotFound)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+		wantCode   string
+	}{
+		{"get", http.MethodGet, "/api/v2/peers/alice", "", http.StatusOK, ""},
+		{"get unknown", http.MethodGet, "/api/v2/peers/bob", "", http.StatusNotFound, "peer_not_found"},
+		{"patch unknown", http.MethodPatch, "/api/v2/peers/bob", `{"enabled": false}`, http.StatusNotFound, "peer_not_found"},
+		{"empty patch", http.MethodPatch, "/api/v2/peers/alice", `{}`, http.StatusBadRequest, "invalid_request"},
+		{"delete unknown", http.MethodDelete, "/api/v2/peers/bob", "", http.StatusNotFound, "peer_not_found"},
+		{"method not allowed", http.MethodPut, "/api/v2/peers/alice", `{}`, http.StatusMethodNotAllowed, "method_not_allowed"},
+		{"unknown path", http.MethodGet, "/api/v2/nope", "", http.StatusNotFound, "not_found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus == http.StatusMethodNotAllowed {
+				if allow := rec.Header().Get("Allow"); allow != "GET, PATCH, DELETE" {
+					t.Errorf("Allow = %q, want %q", allow, "GET, PATCH, DELETE")
+				}
+			}
+			if tt.wantCode == "" {
+				return
+			}
+			var body apiErrorBody
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Error.Code != tt.wantCode {
+				t.Errorf("code = %q, want %q", body.Error.Code, tt.wantCode)
+			}
+		})
+	}
+}
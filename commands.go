@@ -1,26 +1,44 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"log"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func newManagerOrDie() *Manager {
 	cfg, err := LoadConfig()
 	if err != nil {
-		fatal("Not initialized - run 'vpn init' first")
+		if errors.Is(err, os.ErrNotExist) {
+			fatal("Not initialized - run 'vpn init' first")
+		}
+		fatal("Failed to load config: " + err.Error())
+	}
+
+	backend, err := newBackend(cfg)
+	if err != nil {
+		fatal("Invalid backend: " + err.Error())
 	}
 
 	store, err := NewStore(cfg.DataDir)
 	if err != nil {
 		fatal("Failed to open database: " + err.Error())
 	}
+	store.SetSealer(cfg.sealer)
 
-	return NewManager(cfg, store)
+	return NewManager(cfg, store, backend)
 }
 
 func printUsage() {
@@ -29,17 +47,74 @@ func printUsage() {
 	fmt.Println("Usage: vpn <command> [args]")
 	fmt.Println()
 	fmt.Println("Commands:")
-	fmt.Println("  init          Initialize VPN server (generate keys, create config)")
-	fmt.Println("  up            Bring up WireGuard interface (requires sudo)")
-	fmt.Println("  down          Bring down WireGuard interface (requires sudo)")
-	fmt.Println("  add <name>    Add a new peer")
-	fmt.Println("  remove <name> Remove a peer")
-	fmt.Println("  list          List all peers")
-	fmt.Println("  sync          Sync peers to running interface (requires sudo)")
-	fmt.Println("  web [port]    Start REST API (default port 8080, localhost only)")
+	fmt.Println("  init                Initialize VPN server (generate keys, create config)")
+	fmt.Println("                      [--address 10.0.0.1/24] [--address6 fd00::1/64] [--backend wg-quick|netlink]")
+	fmt.Println("                      [--firewall iptables|nftables] [--routes <cidrs>]")
+	fmt.Println("  up                  Bring up WireGuard interface (requires sudo) [--dry-run] [--json]")
+	fmt.Println("  down                Bring down WireGuard interface (requires sudo)")
+	fmt.Println("  add <name>          Add a new peer [--psk] [--pubkey <key>]")
+	fmt.Println("                      [--routes <cidrs>] [--site <cidrs>] [--endpoint <host:port>] [--group <group>]")
+	fmt.Println("  remove <name>       Remove a peer")
+	fmt.Println("  psk rotate <name>   Generate a new preshared key for a peer")
+	fmt.Println("  enable <name>       Re-enable a disabled peer")
+	fmt.Println("  disable <name>      Disable a peer without deleting it")
+	fmt.Println("  config <name>       Print a peer's client config")
+	fmt.Println("  mesh export <name>  Print a mesh peer's config (peers added with --endpoint)")
+	fmt.Println("  list                List all peers")
+	fmt.Println("  group <cmd>         Manage peer groups: create|delete <group>,")
+	fmt.Println("                      add|remove <group> <name>, list")
+	fmt.Println("  policy <cmd>        Manage group firewall policy: add <group> <cidr>[:port][/proto],")
+	fmt.Println("                      remove <id>, list [group]")
+	fmt.Println("  token <cmd>         Manage REST API tokens: create <name> --scope <scopes> [--user <user>],")
+	fmt.Println("                      revoke <name>, list")
+	fmt.Println("  user <cmd>          Manage API users: create <name> --role viewer|operator|admin,")
+	fmt.Println("                      delete <name>, role <name> <role>, own|disown <name> <group>, list")
+	fmt.Println("  sync                Sync peers to running interface (requires sudo)")
+	fmt.Println("                      [--dry-run] [--json] to show the changes without applying them")
+	fmt.Println("  usage <name>        Show traffic history [--since 30d] [--by day|hour] [--json]")
+	fmt.Println("  collect             Sample peer traffic periodically [--interval 5m]")
+	fmt.Println("  agent               Re-apply the database to the interface when it drifts [--interval 1m]")
+	fmt.Println("                      status [--json] shows the latest reconcile result")
+	fmt.Println("  db migrate          Apply pending database migrations (--status to list them)")
+	fmt.Println("  rekey-storage       Encrypt stored keys under a new data key")
+	fmt.Println("                      [--key-file <path> | --env | --passphrase] to set the master key")
+	fmt.Println("  web [port]          Start REST API and /metrics (default port 8080 on localhost)")
+	fmt.Println("                      [--listen <addr:port>] [--tls-cert <file> --tls-key <file> | --self-signed]")
+	fmt.Println("                      [--client-ca <bundle>] to require client certificates")
+	fmt.Println("                      [--socket <path>] [--socket-owner|--socket-group <name>] [--socket-mode 0660]")
+	fmt.Println("                      [--allow-uid|--allow-gid <names>] to serve a Unix socket")
 }
 
-func cmdInit() {
+func cmdInit(args []string) {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	address := fs.String("address", "10.0.0.1/24", "server IPv4 address and pool prefix")
+	address6 := fs.String("address6", "", "server IPv6 address and pool prefix for dual-stack (e.g. fd00::1/64)")
+	backend := fs.String("backend", backendWGQuick, "interface backend: wg-quick or netlink")
+	firewall := fs.String("firewall", firewallIPTables, "firewall tool: iptables or nftables")
+	routesFlag := fs.String("routes", "", "default comma-separated prefixes clients route through the tunnel (default: everything)")
+	fs.Parse(args)
+
+	if *backend != backendWGQuick && *backend != backendNetlink {
+		fatal("Unknown backend: " + *backend)
+	}
+	if *firewall != firewallIPTables && *firewall != firewallNFTables {
+		fatal("Unknown firewall: " + *firewall)
+	}
+
+	if _, _, err := parsePool(*address, false); err != nil {
+		fatal("Invalid --address: " + err.Error())
+	}
+	if *address6 != "" {
+		if _, _, err := parsePool(*address6, true); err != nil {
+			fatal("Invalid --address6: " + err.Error())
+		}
+	}
+
+	routes, err := parseRoutes(*routesFlag)
+	if err != nil {
+		fatal("Invalid --routes: " + err.Error())
+	}
+
 	dir := dataDir()
 	if err := os.MkdirAll(dir, 0700); err != nil {
 		fatal("Failed to create data dir: " + err.Error())
@@ -58,13 +133,17 @@ func cmdInit() {
 	cfg := &Config{
 		Interface:    "wg0",
 		ListenPort:   51820,
-		Address:      "10.0.0.1/24",
+		Address:      *address,
+		Address6:     *address6,
 		Endpoint:     "",
 		PrivateKey:   privKey,
 		PublicKey:    pubKey,
 		DNS:          "1.1.1.1",
 		DataDir:      dir,
 		NATInterface: "eth0",
+		Backend:      *backend,
+		Firewall:     *firewall,
+		ClientRoutes: routes,
 	}
 
 	fmt.Print("Enter public endpoint (e.g., vpn.example.com or IP): ")
@@ -92,21 +171,25 @@ func cmdInit() {
 	fmt.Println("  2. Run 'vpn add <name>' to add peers")
 }
 
-func cmdUp() {
+func cmdUp(args []string) {
+	fs := flag.NewFlagSet("up", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "show the peers that would be configured without bringing the interface up")
+	asJSON := fs.Bool("json", false, "print the dry run as JSON")
+	fs.Parse(args)
+
 	mgr := newManagerOrDie()
 	defer mgr.Close()
 
-	wgConfig, err := mgr.ServerConfig()
-	if err != nil {
-		fatal("Failed to build server config: " + err.Error())
-	}
-
-	wgPath := filepath.Join(mgr.cfg.DataDir, mgr.cfg.Interface+".conf")
-	if err := os.WriteFile(wgPath, []byte(wgConfig), 0600); err != nil {
-		fatal("Failed to write WireGuard config: " + err.Error())
+	if *dryRun {
+		plan, err := mgr.PlanUp()
+		if err != nil {
+			fatal("Failed to plan: " + err.Error())
+		}
+		printSyncPlan(plan, *asJSON)
+		return
 	}
 
-	if err := runSudo("wg-quick", "up", wgPath); err != nil {
+	if err := mgr.Up(); err != nil {
 		fatal("Failed to bring up interface: " + err.Error())
 	}
 
@@ -114,43 +197,137 @@ func cmdUp() {
 }
 
 func cmdDown() {
-	cfg, err := LoadConfig()
-	if err != nil {
-		fatal("Not initialized - run 'vpn init' first")
-	}
+	mgr := newManagerOrDie()
+	defer mgr.Close()
 
-	wgPath := filepath.Join(cfg.DataDir, cfg.Interface+".conf")
-	if err := runSudo("wg-quick", "down", wgPath); err != nil {
+	if err := mgr.Down(); err != nil {
 		fmt.Println("Warning: " + err.Error())
 	}
 	fmt.Println("VPN is down")
 }
 
-func cmdAddPeer(name string) {
+func cmdAddPeer(name string, args []string) {
+	fs := flag.NewFlagSet("add", flag.ExitOnError)
+	psk := fs.Bool("psk", false, "generate a preshared key for the peer")
+	pubKey := fs.String("pubkey", "", "enroll the peer with its own public key (no private key is stored)")
+	routesFlag := fs.String("routes", "", "comma-separated prefixes the client routes through the tunnel (default: server client_routes, else everything)")
+	siteFlag := fs.String("site", "", "comma-separated LAN prefixes behind the peer, routed to it by the server")
+	endpoint := fs.String("endpoint", "", "host:port other peers can reach this peer at; adds it to the mesh")
+	group := fs.String("group", "", "put the peer into this group")
+	fs.Parse(args)
+
+	routes, err := parseRoutes(*routesFlag)
+	if err != nil {
+		fatal(err.Error())
+	}
+	sites, err := parseRoutes(*siteFlag)
+	if err != nil {
+		fatal(err.Error())
+	}
+
 	mgr := newManagerOrDie()
 	defer mgr.Close()
 
-	peer, err := mgr.AddPeer(name)
+	opts := PeerOptions{PresharedKey: *psk, PublicKey: *pubKey, Routes: routes, SiteRoutes: sites, Endpoint: *endpoint, Group: *group}
+	peer, result, err := mgr.AddPeer(name, opts)
 	if err != nil {
 		if errors.Is(err, errPeerExists) {
 			fatal("Peer already exists: " + name)
 		}
+		if errors.Is(err, errGroupNotFound) {
+			fatal("Group not found: " + *group)
+		}
+		if errors.Is(err, errInvalidPublicKey) || errors.Is(err, errPublicKeyInUse) ||
+			errors.Is(err, errRouteOverlap) || errors.Is(err, errInvalidEndpoint) || errors.Is(err, errInvalidPeerName) ||
+			errors.Is(err, errPoolExhausted) {
+			fatal(err.Error())
+		}
 		fatal("Failed to save peer: " + err.Error())
 	}
 
 	fmt.Printf("Added peer: %s\n", name)
 	fmt.Printf("  IP: %s\n", peer.AllowedIP)
+	if peer.AllowedIP6 != "" {
+		fmt.Printf("  IPv6: %s\n", peer.AllowedIP6)
+	}
+	if peer.IsSite() {
+		fmt.Printf("  Site: %s\n", strings.Join(peer.SiteRoutes, ", "))
+	}
+	printClientConfig(mgr, peer)
+	fmt.Println()
+	printSyncResult(result)
+	if peer.IsSite() {
+		fmt.Println("Other site peers route to the new site once they get their config again ('vpn config <name>').")
+	}
+	printStaleMesh(mgr)
+}
+
+// printStaleMesh lists the mesh peers whose config no longer matches the
+// mesh, e.g. after a mesh peer was added or removed.
+func printStaleMesh(mgr *Manager) {
+	stale, err := mgr.StaleMeshPeers()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: mesh status unavailable: "+err.Error())
+		return
+	}
+	if len(stale) > 0 {
+		fmt.Printf("Mesh configs out of date: %s (re-export with 'vpn mesh export <name>').\n", strings.Join(stale, ", "))
+	}
+}
+
+func cmdMeshExport(name string) {
+	mgr := newManagerOrDie()
+	defer mgr.Close()
+
+	config, err := mgr.MeshConfig(name)
+	if err != nil {
+		if errors.Is(err, errPeerNotFound) {
+			fatal("Peer not found: " + name)
+		}
+		if errors.Is(err, errNotMeshPeer) {
+			fatal(name + ": " + err.Error())
+		}
+		fatal("Failed to generate config: " + err.Error())
+	}
+	fmt.Print(config)
+}
+
+// cmdShowConfig prints a peer's current client config, e.g. after the set
+// of sites it routes to has changed.
+func cmdShowConfig(name string) {
+	mgr := newManagerOrDie()
+	defer mgr.Close()
+
+	peer, err := mgr.GetPeer(name)
+	if err != nil {
+		if errors.Is(err, errPeerNotFound) {
+			fatal("Peer not found: " + name)
+		}
+		fatal("Failed to load peer: " + err.Error())
+	}
+	config, err := mgr.ClientConfig(peer)
+	if err != nil {
+		fatal("Failed to generate config: " + err.Error())
+	}
+	fmt.Print(config)
+}
+
+func printClientConfig(mgr *Manager, peer *Peer) {
+	config, err := mgr.ClientConfig(peer)
+	if err != nil {
+		fatal("Failed to generate config: " + err.Error())
+	}
 	fmt.Println("\nClient config:")
 	fmt.Println(strings.Repeat("-", 40))
-	fmt.Println(mgr.ClientConfig(peer))
-	fmt.Println("\nRun 'vpn sync' to apply changes to running VPN.")
+	fmt.Println(config)
 }
 
 func cmdRemovePeer(name string) {
 	mgr := newManagerOrDie()
 	defer mgr.Close()
 
-	if err := mgr.RemovePeer(name); err != nil {
+	result, err := mgr.RemovePeer(name)
+	if err != nil {
 		if errors.Is(err, errPeerNotFound) {
 			fatal("Peer not found: " + name)
 		}
@@ -158,9 +335,196 @@ func cmdRemovePeer(name string) {
 	}
 
 	fmt.Printf("Removed peer: %s\n", name)
+	printSyncResult(result)
+	printStaleMesh(mgr)
+}
+
+// printSyncResult tells whether auto_sync applied the change, or how to
+// apply it by hand.
+func printSyncResult(result *SyncResult) {
+	switch {
+	case result == nil:
+		fmt.Println("Run 'vpn sync' to apply changes to running VPN.")
+	case result.Applied:
+		fmt.Println("Applied changes to running VPN.")
+	default:
+		fmt.Println("Warning: failed to apply changes to running VPN: " + result.Error)
+		fmt.Println("Run 'vpn sync' to apply them once the interface is up.")
+	}
+}
+
+func cmdRotatePSK(name string) {
+	mgr := newManagerOrDie()
+	defer mgr.Close()
+
+	peer, result, err := mgr.RotatePresharedKey(name)
+	if err != nil {
+		if errors.Is(err, errPeerNotFound) {
+			fatal("Peer not found: " + name)
+		}
+		fatal("Failed to rotate preshared key: " + err.Error())
+	}
+
+	fmt.Printf("Rotated preshared key for peer: %s\n", name)
+	printClientConfig(mgr, peer)
+	fmt.Println()
+	printSyncResult(result)
+}
+
+func cmdSetPeerEnabled(name string, enabled bool) {
+	mgr := newManagerOrDie()
+	defer mgr.Close()
+
+	action, setEnabled := "Disabled", mgr.DisablePeer
+	if enabled {
+		action, setEnabled = "Enabled", mgr.EnablePeer
+	}
+
+	result, err := setEnabled(name)
+	if err != nil {
+		if errors.Is(err, errPeerNotFound) {
+			fatal("Peer not found: " + name)
+		}
+		fatal("Failed to update peer: " + err.Error())
+	}
+
+	fmt.Printf("%s peer: %s\n", action, name)
+	printSyncResult(result)
+	printStaleMesh(mgr)
+}
+
+const (
+	groupUsage  = "Usage: vpn group create|delete <group> | add|remove <group> <peer-name> | list"
+	policyUsage = "Usage: vpn policy add <group> <cidr|any>[:port[-port]][/tcp|/udp] | remove <id> | list [group]"
+	tokenUsage  = "Usage: vpn token create <name> --scope <scope>[,<scope>...] [--user <user>] | revoke <name> | list"
+	userUsage   = "Usage: vpn user create <name> --role viewer|operator|admin | delete <name> | role <name> <role> | own|disown <name> <group> | list"
+)
+
+func cmdGroup(args []string) {
+	if len(args) == 0 {
+		fatal(groupUsage)
+	}
+	mgr := newManagerOrDie()
+	defer mgr.Close()
+
+	var err error
+	switch {
+	case args[0] == "list":
+		groups, lerr := mgr.ListGroups()
+		if lerr != nil {
+			fatal("Failed to list groups: " + lerr.Error())
+		}
+		if len(groups) == 0 {
+			fmt.Println("No groups yet. Create one with 'vpn group create <group>'")
+			return
+		}
+		fmt.Printf("%-18s %s\n", "GROUP", "MEMBERS")
+		fmt.Println(strings.Repeat("-", 60))
+		for _, g := range groups {
+			fmt.Printf("%-18s %s\n", g.Name, orDash(strings.Join(g.Members, ", ")))
+		}
+		return
+	case args[0] == "create" && len(args) == 2:
+		if err = mgr.CreateGroup(args[1]); err == nil {
+			fmt.Printf("Created group: %s\n", args[1])
+		}
+	case args[0] == "delete" && len(args) == 2:
+		if err = mgr.DeleteGroup(args[1]); err == nil {
+			fmt.Printf("Deleted group: %s (with its policies)\n", args[1])
+		}
+	case args[0] == "add" && len(args) == 3:
+		if err = mgr.AddGroupMember(args[1], args[2]); err == nil {
+			fmt.Printf("Added %s to group %s\n", args[2], args[1])
+		}
+	case args[0] == "remove" && len(args) == 3:
+		if err = mgr.RemoveGroupMember(args[1], args[2]); err == nil {
+			fmt.Printf("Removed %s from group %s\n", args[2], args[1])
+		}
+	default:
+		fatal(groupUsage)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, errGroupNotFound):
+			fatal("Group not found: " + args[1])
+		case errors.Is(err, errPeerNotFound):
+			fatal("Peer not found: " + args[2])
+		case errors.Is(err, errGroupExists), errors.Is(err, errInvalidGroupName):
+			fatal(err.Error())
+		}
+		fatal("Failed to update group: " + err.Error())
+	}
 	fmt.Println("Run 'vpn sync' to apply changes to running VPN.")
 }
 
+func cmdPolicy(args []string) {
+	if len(args) == 0 {
+		fatal(policyUsage)
+	}
+
+	switch {
+	case args[0] == "list" && len(args) <= 2:
+		mgr := newManagerOrDie()
+		defer mgr.Close()
+
+		group := ""
+		if len(args) == 2 {
+			group = args[1]
+		}
+		policies, err := mgr.ListPolicies(group)
+		if err != nil {
+			fatal("Failed to list policies: " + err.Error())
+		}
+		if len(policies) == 0 {
+			fmt.Println("No policies. Grouped peers can reach nothing until a policy allows it.")
+			return
+		}
+		fmt.Printf("%-6s %-18s %s\n", "ID", "GROUP", "ALLOWS")
+		fmt.Println(strings.Repeat("-", 60))
+		for _, p := range policies {
+			fmt.Printf("%-6d %-18s %s\n", p.ID, p.Group, p.String())
+		}
+	case args[0] == "add" && len(args) == 3:
+		policy, err := parsePolicyTarget(args[2])
+		if err != nil {
+			fatal(err.Error())
+		}
+		policy.Group = args[1]
+
+		mgr := newManagerOrDie()
+		defer mgr.Close()
+
+		id, err := mgr.AddPolicy(policy)
+		if err != nil {
+			if errors.Is(err, errGroupNotFound) {
+				fatal("Group not found: " + args[1])
+			}
+			fatal("Failed to add policy: " + err.Error())
+		}
+		fmt.Printf("Added policy %d: %s may reach %s\n", id, policy.Group, policy.String())
+		fmt.Println("Run 'vpn sync' to apply changes to running VPN.")
+	case args[0] == "remove" && len(args) == 2:
+		id, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			fatal("Invalid policy id: " + args[1])
+		}
+
+		mgr := newManagerOrDie()
+		defer mgr.Close()
+
+		if err := mgr.RemovePolicy(id); err != nil {
+			if errors.Is(err, errPolicyNotFound) {
+				fatal("Policy not found: " + args[1])
+			}
+			fatal("Failed to remove policy: " + err.Error())
+		}
+		fmt.Printf("Removed policy %d\n", id)
+		fmt.Println("Run 'vpn sync' to apply changes to running VPN.")
+	default:
+		fatal(policyUsage)
+	}
+}
+
 func cmdListPeers() {
 	mgr := newManagerOrDie()
 	defer mgr.Close()
@@ -170,64 +534,817 @@ func cmdListPeers() {
 		fatal("Failed to list peers: " + err.Error())
 	}
 
-	fmt.Printf("%-20s %-15s %-10s %s\n", "NAME", "IP", "STATUS", "CREATED")
-	fmt.Println(strings.Repeat("-", 60))
+	statuses, err := mgr.PeerStatuses()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: live status unavailable: "+err.Error())
+	}
+
+	dualStack := mgr.cfg.Address6 != ""
+	header := []string{"NAME", "IP"}
+	if dualStack {
+		header = append(header, "IPV6")
+	}
+	header = append(header, "STATUS", "ONLINE", "HANDSHAKE", "ENDPOINT", "RX", "TX", "CREATED")
+	printPeerRow(header, dualStack)
+	fmt.Println(strings.Repeat("-", peerRowWidth(dualStack)))
 
+	now := time.Now()
 	for _, peer := range peers {
 		status := "enabled"
 		if !peer.Enabled {
 			status = "disabled"
 		}
-		fmt.Printf("%-20s %-15s %-10s %s\n", peer.Name, strings.TrimSuffix(peer.AllowedIP, "/32"), status, peer.CreatedAt.Format("2006-01-02"))
+		row := []string{peer.Name, peer.IP()}
+		if dualStack {
+			row = append(row, orDash(peer.IP6()))
+		}
+		row = append(row, status)
+
+		if st, ok := statuses[peer.PublicKey]; ok {
+			online := "offline"
+			if st.Online(now) {
+				online = "online"
+			}
+			handshake := "never"
+			if !st.LastHandshake.IsZero() {
+				handshake = formatAgo(now.Sub(st.LastHandshake))
+			}
+			row = append(row, online, handshake, orDash(st.Endpoint), formatBytes(st.RxBytes), formatBytes(st.TxBytes))
+		} else {
+			row = append(row, "-", "-", "-", "-", "-")
+		}
+		printPeerRow(append(row, peer.CreatedAt.Format("2006-01-02")), dualStack)
+	}
+	printStaleMesh(mgr)
+}
+
+var peerColumnWidths = []int{20, 15, 10, 8, 10, 22, 10, 10}
+
+func peerColumns(dualStack bool) []int {
+	if !dualStack {
+		return peerColumnWidths
+	}
+	return append([]int{20, 15, 25}, peerColumnWidths[2:]...)
+}
+
+func printPeerRow(cols []string, dualStack bool) {
+	widths := peerColumns(dualStack)
+	var sb strings.Builder
+	for i, col := range cols {
+		if i < len(widths) {
+			sb.WriteString(fmt.Sprintf("%-*s ", widths[i], col))
+		} else {
+			sb.WriteString(col)
+		}
+	}
+	fmt.Println(sb.String())
+}
+
+func peerRowWidth(dualStack bool) int {
+	width := 10 // CREATED
+	for _, w := range peerColumns(dualStack) {
+		width += w + 1
+	}
+	return width
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// formatAgo renders a duration as a short "5m ago" style string.
+func formatAgo(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds ago", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh ago", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%dd ago", int(d.Hours()/24))
 	}
 }
 
-func cmdSync() {
+// formatBytes renders a byte count with binary units.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func cmdSync(args []string) {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "show what would change on the running interface without applying it")
+	asJSON := fs.Bool("json", false, "print the dry run as JSON")
+	fs.Parse(args)
+
 	mgr := newManagerOrDie()
 	defer mgr.Close()
 
-	wgConfig, err := mgr.ServerConfig()
+	if *dryRun {
+		plan, err := mgr.PlanSync()
+		if err != nil {
+			fatal("Failed to read interface state: " + err.Error())
+		}
+		printSyncPlan(plan, *asJSON)
+		return
+	}
+
+	if err := mgr.Sync(); err != nil {
+		fatal("Failed to sync: " + err.Error())
+	}
+	fmt.Println("Synced peers to WireGuard")
+}
+
+func peerLabel(c PeerChange) string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return c.PublicKey
+}
+
+// printSyncPlan prints a plan as a diff: + for peers to add, - for peers
+// to remove and ~ for peers whose AllowedIPs change.
+func printSyncPlan(plan SyncPlan, asJSON bool) {
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(plan)
+		return
+	}
+	if plan.Empty() {
+		fmt.Println("No changes")
+		return
+	}
+	for _, c := range plan.Add {
+		fmt.Printf("+ %-20s %s\n", peerLabel(c), strings.Join(c.AllowedIPs, ", "))
+	}
+	for _, c := range plan.Remove {
+		fmt.Printf("- %-20s %s\n", peerLabel(c), strings.Join(c.LiveAllowedIPs, ", "))
+	}
+	for _, c := range plan.Change {
+		fmt.Printf("~ %-20s %s\n", peerLabel(c), describeChange(c))
+	}
+	fmt.Printf("%d to add, %d to remove, %d to change\n", len(plan.Add), len(plan.Remove), len(plan.Change))
+}
+
+// describeChange shows a changed peer's AllowedIPs, as "live -> desired"
+// when they differ, and notes a preshared key change.
+func describeChange(c PeerChange) string {
+	ips := strings.Join(c.AllowedIPs, ", ")
+	if live := strings.Join(c.LiveAllowedIPs, ", "); live != ips {
+		ips = live + " -> " + ips
+	}
+	if c.PresharedKey {
+		ips += " (preshared key)"
+	}
+	return ips
+}
+
+func cmdUsage(name string, args []string) {
+	fs := flag.NewFlagSet("usage", flag.ExitOnError)
+	sinceFlag := fs.String("since", "30d", "how far back to report (e.g. 30d, 12h, 2006-01-02)")
+	by := fs.String("by", usageByDay, "rollup: day or hour")
+	asJSON := fs.Bool("json", false, "print JSON")
+	fs.Parse(args)
+
+	since, err := parseSince(*sinceFlag, time.Now())
 	if err != nil {
-		fatal("Failed to build server config: " + err.Error())
+		fatal(err.Error())
 	}
 
-	wgPath := filepath.Join(mgr.cfg.DataDir, mgr.cfg.Interface+".conf")
-	if err := os.WriteFile(wgPath, []byte(wgConfig), 0600); err != nil {
-		fatal("Failed to write config: " + err.Error())
+	mgr := newManagerOrDie()
+	defer mgr.Close()
+
+	buckets, err := mgr.Usage(name, since, *by)
+	if err != nil {
+		if errors.Is(err, errPeerNotFound) {
+			fatal("Peer not found: " + name)
+		}
+		fatal("Failed to load usage: " + err.Error())
 	}
 
-	peerConf := extractPeerConfig(wgConfig)
-	tmpPath := filepath.Join(mgr.cfg.DataDir, "peers.conf")
-	if err := os.WriteFile(tmpPath, []byte(peerConf), 0600); err != nil {
-		fatal("Failed to write peers temp file: " + err.Error())
+	if *asJSON {
+		if buckets == nil {
+			buckets = []UsageBucket{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(buckets)
+		return
 	}
 
-	if mgr.cfg.Interface == "" {
-		fatal("WireGuard interface not set in config.")
+	layout := "2006-01-02"
+	if *by == usageByHour {
+		layout = "2006-01-02 15:00"
+	}
+	fmt.Printf("%-18s %-12s %s\n", "PERIOD (UTC)", "RX", "TX")
+	fmt.Println(strings.Repeat("-", 44))
+	var rx, tx int64
+	for _, b := range buckets {
+		fmt.Printf("%-18s %-12s %s\n", b.Start.Format(layout), formatBytes(b.RxBytes), formatBytes(b.TxBytes))
+		rx += b.RxBytes
+		tx += b.TxBytes
 	}
+	fmt.Println(strings.Repeat("-", 44))
+	fmt.Printf("%-18s %-12s %s\n", "TOTAL", formatBytes(rx), formatBytes(tx))
+}
 
-	if err := runSudo("wg", "syncconf", mgr.cfg.Interface, tmpPath); err != nil {
-		fatal("Failed to sync: " + err.Error())
+func cmdCollect(args []string) {
+	fs := flag.NewFlagSet("collect", flag.ExitOnError)
+	interval := fs.Duration("interval", 5*time.Minute, "sampling interval")
+	fs.Parse(args)
+	if *interval <= 0 {
+		fatal("--interval must be positive")
+	}
+	sudoPrompt = false
+
+	mgr := newManagerOrDie()
+	defer mgr.Close()
+
+	fmt.Printf("Sampling peer traffic every %s\n", *interval)
+	fmt.Println("Press Ctrl+C to stop")
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		if n, err := mgr.CollectUsage(); err != nil {
+			log.Printf("collect usage: %v", err)
+		} else {
+			log.Printf("recorded usage for %d peers", n)
+		}
+		<-ticker.C
+	}
+}
+
+func cmdToken(args []string) {
+	if len(args) == 0 {
+		fatal(tokenUsage)
+	}
+	mgr := newManagerOrDie()
+	defer mgr.Close()
+
+	switch {
+	case args[0] == "list":
+		tokens, err := mgr.ListTokens()
+		if err != nil {
+			fatal("Failed to list tokens: " + err.Error())
+		}
+		if len(tokens) == 0 {
+			fmt.Println("No API tokens yet. Create one with 'vpn token create <name> --scope <scopes>'")
+			return
+		}
+		fmt.Printf("%-20s %-16s %-40s %-12s %s\n", "NAME", "USER", "SCOPES", "CREATED", "LAST USED")
+		fmt.Println(strings.Repeat("-", 107))
+		for _, t := range tokens {
+			lastUsed := "-"
+			if !t.LastUsedAt.IsZero() {
+				lastUsed = t.LastUsedAt.Format("2006-01-02 15:04")
+			}
+			fmt.Printf("%-20s %-16s %-40s %-12s %s\n", t.Name, orDash(t.User), strings.Join(t.Scopes, ","), t.CreatedAt.Format("2006-01-02"), lastUsed)
+		}
+	case args[0] == "create" && len(args) >= 2:
+		fs := flag.NewFlagSet("token create", flag.ExitOnError)
+		scopeFlag := fs.String("scope", "", "comma-separated scopes: "+strings.Join(allScopes, ", "))
+		user := fs.String("user", "", "user the token acts as; its role limits the scopes")
+		fs.Parse(args[2:])
+
+		scopes, err := parseScopes(*scopeFlag)
+		if err != nil {
+			fatal(err.Error())
+		}
+		token, err := mgr.CreateToken(args[1], *user, scopes)
+		if err != nil {
+			if errors.Is(err, errTokenExists) || errors.Is(err, errInvalidTokenName) {
+				fatal(err.Error())
+			}
+			if errors.Is(err, errUserNotFound) {
+				fatal("User not found: " + *user)
+			}
+			fatal("Failed to create token: " + err.Error())
+		}
+		fmt.Printf("Created token %s with scopes %s\n", args[1], strings.Join(scopes, ", "))
+		fmt.Println("Store it now; it cannot be shown again:")
+		fmt.Println(token)
+	case args[0] == "revoke" && len(args) == 2:
+		if err := mgr.RevokeToken(args[1]); err != nil {
+			if errors.Is(err, errTokenNotFound) {
+				fatal("Token not found: " + args[1])
+			}
+			fatal("Failed to revoke token: " + err.Error())
+		}
+		fmt.Printf("Revoked token: %s\n", args[1])
+	default:
+		fatal(tokenUsage)
+	}
+}
+
+func cmdUser(args []string) {
+	if len(args) == 0 {
+		fatal(userUsage)
+	}
+	mgr := newManagerOrDie()
+	defer mgr.Close()
+
+	var err error
+	switch {
+	case args[0] == "list":
+		users, lerr := mgr.ListUsers()
+		if lerr != nil {
+			fatal("Failed to list users: " + lerr.Error())
+		}
+		if len(users) == 0 {
+			fmt.Println("No users yet. Create one with 'vpn user create <name> --role <role>'")
+			return
+		}
+		fmt.Printf("%-20s %-10s %s\n", "USER", "ROLE", "OWNS GROUPS")
+		fmt.Println(strings.Repeat("-", 60))
+		for _, u := range users {
+			fmt.Printf("%-20s %-10s %s\n", u.Name, u.Role, orDash(strings.Join(u.Groups, ", ")))
+		}
+		return
+	case args[0] == "create" && len(args) >= 2:
+		fs := flag.NewFlagSet("user create", flag.ExitOnError)
+		role := fs.String("role", roleViewer, "viewer, operator or admin")
+		fs.Parse(args[2:])
+		if err = mgr.CreateUser(args[1], *role); err == nil {
+			fmt.Printf("Created user: %s (%s)\n", args[1], *role)
+		}
+	case args[0] == "delete" && len(args) == 2:
+		if err = mgr.DeleteUser(args[1]); err == nil {
+			fmt.Printf("Deleted user: %s (with its tokens)\n", args[1])
+		}
+	case args[0] == "role" && len(args) == 3:
+		if err = mgr.SetUserRole(args[1], args[2]); err == nil {
+			fmt.Printf("User %s is now %s\n", args[1], args[2])
+		}
+	case args[0] == "own" && len(args) == 3:
+		if err = mgr.AddUserGroup(args[1], args[2]); err == nil {
+			fmt.Printf("User %s now owns group %s\n", args[1], args[2])
+		}
+	case args[0] == "disown" && len(args) == 3:
+		if err = mgr.RemoveUserGroup(args[1], args[2]); err == nil {
+			fmt.Printf("User %s no longer owns group %s\n", args[1], args[2])
+		}
+	default:
+		fatal(userUsage)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, errUserNotFound):
+			fatal("User not found: " + args[1])
+		case errors.Is(err, errGroupNotFound):
+			fatal("Group not found: " + args[2])
+		}
+		fatal(err.Error())
+	}
+}
+
+// cmdAgent keeps the interface in line with the database until stopped, or
+// with "status" prints the result of its latest pass.
+func cmdAgent(args []string) {
+	if len(args) > 0 && args[0] == "status" {
+		cmdAgentStatus(args[1:])
+		return
+	}
+	fs := flag.NewFlagSet("agent", flag.ExitOnError)
+	interval := fs.Duration("interval", time.Minute, "reconcile interval")
+	fs.Parse(args)
+	if *interval <= 0 {
+		fatal("--interval must be positive")
+	}
+	sudoPrompt = false
+
+	mgr := newManagerOrDie()
+	defer mgr.Close()
+
+	fmt.Printf("Reconciling %s every %s\n", mgr.cfg.Interface, *interval)
+	fmt.Println("Press Ctrl+C to stop")
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		result := mgr.Reconcile()
+		result.Interval = interval.String()
+		logReconcile(result)
+		if err := mgr.SaveAgentStatus(result); err != nil {
+			log.Printf("save agent status: %v", err)
+		}
+		<-ticker.C
+	}
+}
+
+func logReconcile(result ReconcileResult) {
+	for _, c := range result.Drift.Add {
+		log.Printf("drift: %s missing from interface", peerLabel(c))
+	}
+	for _, c := range result.Drift.Remove {
+		log.Printf("drift: %s on interface but not enabled in database", peerLabel(c))
+	}
+	for _, c := range result.Drift.Change {
+		log.Printf("drift: %s differs: %s", peerLabel(c), describeChange(c))
+	}
+	switch {
+	case result.Error != "":
+		log.Printf("reconcile failed: %s", result.Error)
+	case result.Applied:
+		log.Printf("corrected %d peers", len(result.Drift.Add)+len(result.Drift.Remove)+len(result.Drift.Change))
+	}
+}
+
+func cmdAgentStatus(args []string) {
+	fs := flag.NewFlagSet("agent status", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print JSON")
+	fs.Parse(args)
+
+	mgr := newManagerOrDie()
+	defer mgr.Close()
+
+	result, err := mgr.AgentStatus()
+	if err != nil {
+		fatal(err.Error())
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(result)
+		return
+	}
+
+	fmt.Printf("Last reconcile: %s (%s ago)\n", result.Time.Local().Format("2006-01-02 15:04:05"),
+		time.Since(result.Time).Round(time.Second))
+	if result.Interval != "" {
+		fmt.Printf("Interval:       %s\n", result.Interval)
+	}
+	switch {
+	case result.Error != "":
+		fmt.Printf("Result:         failed: %s\n", result.Error)
+	case result.Applied:
+		fmt.Println("Result:         corrected drift")
+	default:
+		fmt.Println("Result:         in sync")
+	}
+	if !result.Drift.Empty() {
+		fmt.Println()
+		printSyncPlan(result.Drift, false)
+	}
+}
+
+// cmdMigrate applies pending schema migrations, or with --status lists them
+// without touching the database. It does not need config.json, so it also
+// works on a data dir copied from another host.
+func cmdMigrate(args []string) {
+	fs := flag.NewFlagSet("db migrate", flag.ExitOnError)
+	status := fs.Bool("status", false, "list migrations without applying them")
+	fs.Parse(args)
+
+	store, err := openStore("")
+	if err != nil {
+		fatal("Failed to open database: " + err.Error())
+	}
+	defer store.Close()
+
+	if !*status {
+		applied, err := store.Migrate()
+		for _, m := range applied {
+			fmt.Printf("Applied %3d  %s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			fatal("Migration failed: " + err.Error())
+		}
+		if len(applied) == 0 {
+			fmt.Printf("Schema is up to date (version %d)\n", schemaVersion())
+		}
+		return
+	}
+
+	statuses, err := store.MigrationStatus()
+	if err != nil {
+		fatal("Failed to read migrations: " + err.Error())
+	}
+	fmt.Printf("%-8s %-28s %s\n", "VERSION", "NAME", "APPLIED")
+	fmt.Println(strings.Repeat("-", 60))
+	pending := 0
+	for _, m := range statuses {
+		applied := "pending"
+		switch {
+		case !m.Known:
+			applied = m.AppliedAt.Format("2006-01-02 15:04:05") + " (unknown to this binary)"
+		case m.Applied():
+			applied = m.AppliedAt.Format("2006-01-02 15:04:05")
+		default:
+			pending++
+		}
+		fmt.Printf("%-8d %-28s %s\n", m.Version, m.Name, applied)
+	}
+	if pending > 0 {
+		fmt.Printf("\n%d pending; run 'vpn db migrate' or any other command to apply them\n", pending)
+	}
+}
+
+// cmdRekeyStorage encrypts the stored private keys under a fresh data key.
+// The first run enables encryption and needs a master key source; later runs
+// rotate the data key and, with a source flag, change the master key too.
+func cmdRekeyStorage(args []string) {
+	fs := flag.NewFlagSet("rekey-storage", flag.ExitOnError)
+	keyFile := fs.String("key-file", "", "read the master key from this file (created if missing)")
+	useEnv := fs.Bool("env", false, "read the master key from "+masterKeyEnv)
+	usePassphrase := fs.Bool("passphrase", false, "derive the master key from a passphrase")
+	fs.Parse(args)
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			fatal("Not initialized - run 'vpn init' first")
+		}
+		fatal("Failed to load config: " + err.Error())
+	}
+
+	var enc EncryptionConfig
+	sources := 0
+	if *keyFile != "" {
+		sources++
+		abs, err := filepath.Abs(*keyFile)
+		if err != nil {
+			fatal("Invalid key file: " + err.Error())
+		}
+		enc = EncryptionConfig{KeySource: keySourceFile, KeyFile: abs}
+	}
+	if *useEnv {
+		sources++
+		enc = EncryptionConfig{KeySource: keySourceEnv}
+	}
+	if *usePassphrase {
+		sources++
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			fatal("Failed to generate salt: " + err.Error())
+		}
+		enc = EncryptionConfig{KeySource: keySourcePassphrase, Salt: base64.StdEncoding.EncodeToString(salt)}
+	}
+	switch {
+	case sources > 1:
+		fatal("Choose only one of --key-file, --env and --passphrase")
+	case sources == 0 && cfg.Encryption == nil:
+		fatal("Storage is not encrypted yet; choose a master key with --key-file, --env or --passphrase")
+	case sources == 0:
+		enc = *cfg.Encryption
+	}
+
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		fatal("Failed to generate storage key: " + err.Error())
+	}
+	if err := wrapStorageKey(&enc, dek); err != nil {
+		fatal("Failed to wrap storage key: " + err.Error())
+	}
+	next, err := newSealer(dek)
+	if err != nil {
+		fatal(err.Error())
+	}
+
+	store, err := NewStore(cfg.DataDir)
+	if err != nil {
+		fatal("Failed to open database: " + err.Error())
+	}
+	defer store.Close()
+	store.SetSealer(cfg.sealer)
+
+	prevEnc, prevSealer := cfg.Encryption, cfg.sealer
+	n, err := store.ResealSecrets(next, func() error {
+		cfg.Encryption, cfg.sealer = &enc, next
+		return SaveConfig(cfg)
+	})
+	if err != nil {
+		if cfg.sealer == next {
+			// The new config was written but the rows were not; put the
+			// old data key back so the database stays readable.
+			cfg.Encryption, cfg.sealer = prevEnc, prevSealer
+			_ = SaveConfig(cfg)
+		}
+		fatal("Failed to re-encrypt stored keys: " + err.Error())
+	}
+
+	fmt.Printf("Encrypted stored keys of %d peers and the server key (master key: %s)\n", n, enc.KeySource)
+	if enc.KeySource == keySourceFile {
+		fmt.Printf("  Master key file: %s (keep it outside backups of %s)\n", enc.KeyFile, cfg.DataDir)
 	}
-	fmt.Println("Synced peers to WireGuard")
 }
-func cmdWeb(port string) {
+
+// cmdWeb serves the REST API. It listens on localhost unless --listen says
+// otherwise, and speaks TLS when given a certificate or --self-signed. With
+// --socket it serves a Unix socket instead, or as well if a port or
+// --listen is also given.
+func cmdWeb(args []string) {
+	port := "8080"
+	portGiven := false
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		port, args, portGiven = args[0], args[1:], true
+	}
+	fs := flag.NewFlagSet("web", flag.ExitOnError)
+	listen := fs.String("listen", "", "address to listen on (default 127.0.0.1:<port>)")
+	tlsCert := fs.String("tls-cert", "", "TLS certificate file (PEM)")
+	tlsKey := fs.String("tls-key", "", "TLS private key file (PEM)")
+	clientCA := fs.String("client-ca", "", "require client certificates signed by a CA in this PEM bundle")
+	selfSigned := fs.Bool("self-signed", false, "use a self-signed certificate, generated in the data dir on first run")
+	socket := fs.String("socket", "", "serve the API on this Unix socket")
+	socketOwner := fs.String("socket-owner", "", "owner of the socket, user name or uid (default: current user)")
+	socketGroup := fs.String("socket-group", "", "group of the socket, name or gid; callers with it as their primary group may call the API")
+	socketMode := fs.String("socket-mode", "0660", "permissions of the socket (octal)")
+	allowUID := fs.String("allow-uid", "", "comma-separated users or uids allowed on the socket besides root and the owner")
+	allowGID := fs.String("allow-gid", "", "comma-separated groups or gids allowed on the socket (primary group only)")
+	fs.Parse(args)
+
+	addr := *listen
+	if addr == "" {
+		addr = "127.0.0.1:" + port
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		fatal("--tls-cert and --tls-key must be given together")
+	}
+	if *selfSigned && *tlsCert != "" {
+		fatal("Choose either --self-signed or --tls-cert/--tls-key")
+	}
+	useTLS := *tlsCert != "" || *selfSigned
+	if *clientCA != "" && !useTLS {
+		fatal("--client-ca needs TLS: pass --tls-cert/--tls-key or --self-signed")
+	}
+
+	// Requests must not wait on a sudo password prompt in the server's
+	// terminal.
+	sudoPrompt = false
+	serveTCP := *socket == "" || portGiven || *listen != ""
+
+	var socketLn net.Listener
+	var access socketAccess
+	if *socket != "" {
+		socketLn, access = openAPISocket(*socket, *socketOwner, *socketGroup, *socketMode, *allowUID, *allowGID)
+		defer socketLn.Close()
+	}
+
 	mgr := newManagerOrDie()
 	defer mgr.Close()
 
+	var tlsConfig *tls.Config
+	if useTLS {
+		certFile, keyFile := *tlsCert, *tlsKey
+		if *selfSigned {
+			var err error
+			certFile, keyFile, err = ensureSelfSignedCert(filepath.Join(mgr.cfg.DataDir, "tls"), selfSignedHosts(mgr.cfg, addr))
+			if err != nil {
+				fatal("Failed to create self-signed certificate: " + err.Error())
+			}
+			if fp, err := certFingerprint(certFile); err == nil {
+				fmt.Printf("Self-signed certificate %s\n  SHA-256 fingerprint: %s\n", certFile, fp)
+			}
+		}
+		var err error
+		if tlsConfig, err = serverTLSConfig(certFile, keyFile, *clientCA); err != nil {
+			fatal(err.Error())
+		}
+	}
+
 	api := NewAPIServer(mgr)
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/api/peers", api.HandlePeers)
-	mux.HandleFunc("/api/peer/add", api.HandleAddPeer)
-	mux.HandleFunc("/api/peer/remove", api.HandleRemovePeer)
+	mux.HandleFunc("/api/peers", api.Require(scopePeersRead, api.HandlePeers))
+	mux.HandleFunc("/api/peer/add", api.Require(scopePeersWrite, api.HandleAddPeer))
+	mux.HandleFunc("/api/peer/remove", api.Require(scopePeersWrite, api.HandleRemovePeer))
+	mux.HandleFunc("/api/peer/enable", api.Require(scopePeersWrite, api.HandleEnablePeer))
+	mux.HandleFunc("/api/peer/disable", api.Require(scopePeersWrite, api.HandleDisablePeer))
+	mux.HandleFunc("GET /api/peers/{name}/usage", api.Require(scopePeersRead, api.HandlePeerUsage))
+	mux.HandleFunc("/api/groups", api.Require(scopeGroupsRead, api.HandleGroups))
+	mux.HandleFunc("/api/group/create", api.Require(scopeGroupsWrite, api.HandleCreateGroup))
+	mux.HandleFunc("/api/group/delete", api.Require(scopeGroupsWrite, api.HandleDeleteGroup))
+	mux.HandleFunc("/api/group/add", api.Require(scopeGroupsWrite, api.HandleAddGroupMember))
+	mux.HandleFunc("/api/group/remove", api.Require(scopeGroupsWrite, api.HandleRemoveGroupMember))
+	mux.HandleFunc("/api/policies", api.Require(scopeGroupsRead, api.HandlePolicies))
+	mux.HandleFunc("/api/policy/add", api.Require(scopeGroupsWrite, api.HandleAddPolicy))
+	mux.HandleFunc("/api/policy/remove", api.Require(scopeGroupsWrite, api.HandleRemovePolicy))
+	mux.HandleFunc("GET /api/v2/peers", api.Require(scopePeersRead, api.HandleV2ListPeers))
+	mux.HandleFunc("POST /api/v2/peers", api.Require(scopePeersWrite, api.HandleV2CreatePeer))
+	mux.HandleFunc("/api/v2/peers", V2MethodNotAllowed("GET, POST"))
+	mux.HandleFunc("GET /api/v2/peers/{name}", api.Require(scopePeersRead, api.HandleV2GetPeer))
+	mux.HandleFunc("PATCH /api/v2/peers/{name}", api.Require(scopePeersWrite, api.HandleV2UpdatePeer))
+	mux.HandleFunc("DELETE /api/v2/peers/{name}", api.Require(scopePeersWrite, api.HandleV2DeletePeer))
+	mux.HandleFunc("/api/v2/peers/{name}", V2MethodNotAllowed("GET, PATCH, DELETE"))
+	mux.HandleFunc("/api/v2/", V2NotFound)
+	mux.HandleFunc("/metrics", api.Require(scopeMetricsRead, api.HandleMetrics))
 	mux.HandleFunc("/", api.NotFound)
 
-	fmt.Printf("REST API running at http://localhost:%s\n", port)
-	fmt.Println("API is bound to localhost; use SSH tunneling for remote access.")
+	errc := make(chan error, 2)
+	if socketLn != nil {
+		fmt.Printf("REST API running on unix socket %s\n", *socket)
+		srv := &http.Server{
+			Handler:           api.Instrument(api.RequireLocal(access, mux)),
+			ConnContext:       socketConnContext,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() { errc <- srv.Serve(socketLn) }()
+	}
+	if serveTCP {
+		if tokens, err := mgr.ListTokens(); err == nil && len(tokens) == 0 {
+			fmt.Println("No API tokens yet; every request will be refused. Create one with 'vpn token create'.")
+		}
+		scheme := "http"
+		if useTLS {
+			scheme = "https"
+		}
+		fmt.Printf("REST API running at %s://%s\n", scheme, addr)
+		switch {
+		case *clientCA != "":
+			fmt.Println("Clients must present a certificate signed by " + *clientCA)
+		case !useTLS && !isLoopbackAddr(addr):
+			fmt.Println("Warning: serving without TLS on a non-loopback address sends API tokens in the clear")
+		case !useTLS:
+			fmt.Println("API is bound to localhost; use SSH tunneling or TLS (--listen with --tls-cert/--self-signed) for remote access.")
+		}
+
+		srv := &http.Server{
+			Addr:              addr,
+			Handler:           api.Instrument(mux),
+			TLSConfig:         tlsConfig,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			if useTLS {
+				errc <- srv.ListenAndServeTLS("", "")
+			} else {
+				errc <- srv.ListenAndServe()
+			}
+		}()
+	}
 	fmt.Println("Press Ctrl+C to stop")
 
-	if err := http.ListenAndServe("127.0.0.1:"+port, mux); err != nil {
+	if err := <-errc; err != nil {
 		fatal("Failed to start web server: " + err.Error())
 	}
 }
+
+// openAPISocket creates the API socket from the --socket flags and works
+// out who may connect: root, the socket owner, this process's user and the
+// listed users and groups, plus the socket group's members.
+func openAPISocket(path, owner, group, mode, allowUID, allowGID string) (net.Listener, socketAccess) {
+	uid, gid := os.Getuid(), os.Getgid()
+	var access socketAccess
+	if owner != "" {
+		id, err := lookupUID(owner)
+		if err != nil {
+			fatal("Invalid --socket-owner: " + err.Error())
+		}
+		uid = int(id)
+	}
+	if group != "" {
+		id, err := lookupGID(group)
+		if err != nil {
+			fatal("Invalid --socket-group: " + err.Error())
+		}
+		gid = int(id)
+		access.GIDs = append(access.GIDs, id)
+	}
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || perm > 0o777 {
+		fatal("Invalid --socket-mode: " + mode)
+	}
+	uids, err := parseIDList(allowUID, lookupUID)
+	if err != nil {
+		fatal("Invalid --allow-uid: " + err.Error())
+	}
+	gids, err := parseIDList(allowGID, lookupGID)
+	if err != nil {
+		fatal("Invalid --allow-gid: " + err.Error())
+	}
+	access.UIDs = append(uids, uint32(uid), uint32(os.Geteuid()))
+	access.GIDs = append(access.GIDs, gids...)
+
+	ln, err := listenSocket(path, uid, gid, os.FileMode(perm))
+	if err != nil {
+		fatal("Failed to open socket: " + err.Error())
+	}
+	return ln, access
+}
+
+// isLoopbackAddr reports whether a listen address only accepts local
+// connections.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -12,12 +12,50 @@ type Config struct {
 	Interface    string `json:"interface"`
 	ListenPort   int    `json:"listen_port"`
 	Address      string `json:"address"`
+	Address6     string `json:"address6,omitempty"`
 	Endpoint     string `json:"endpoint"`
 	PrivateKey   string `json:"private_key"`
 	PublicKey    string `json:"public_key"`
 	DNS          string `json:"dns"`
 	DataDir      string `json:"data_dir"`
 	NATInterface string `json:"nat_interface"`
+	// Backend selects how the interface is managed: "wg-quick" (default)
+	// shells out through sudo, "netlink" configures the kernel directly.
+	Backend string `json:"backend,omitempty"`
+	// Firewall selects the tool for the NAT and group rules: "iptables"
+	// (default) or "nftables".
+	Firewall string `json:"firewall,omitempty"`
+	// AutoSync applies added and removed peers to the running interface
+	// right away instead of waiting for `vpn sync`.
+	AutoSync bool `json:"auto_sync,omitempty"`
+	// PresharedKeys gives every new peer a preshared key, as if added with
+	// --psk.
+	PresharedKeys bool `json:"preshared_keys,omitempty"`
+	// ClientRoutes are the prefixes clients send through the tunnel unless
+	// a peer has its own; empty means full tunnel.
+	ClientRoutes []string `json:"client_routes,omitempty"`
+	// Encryption is set once `vpn rekey-storage` has enabled encryption of
+	// stored private keys.
+	Encryption *EncryptionConfig `json:"encryption,omitempty"`
+
+	// sealer holds the unwrapped data key while the config is loaded.
+	sealer *sealer
+}
+
+const (
+	backendWGQuick = "wg-quick"
+	backendNetlink = "netlink"
+
+	firewallIPTables = "iptables"
+	firewallNFTables = "nftables"
+)
+
+// Addresses returns the server interface addresses, IPv4 first.
+func (c *Config) Addresses() []string {
+	if c.Address6 == "" {
+		return []string{c.Address}
+	}
+	return []string{c.Address, c.Address6}
 }
 
 func dataDir() string {
@@ -46,6 +84,15 @@ func LoadConfig() (*Config, error) {
 	}
 	cfg.DataDir = dir
 
+	if cfg.Encryption != nil {
+		if cfg.sealer, err = unlockStorage(cfg.Encryption); err != nil {
+			return nil, fmt.Errorf("unlock storage: %w", err)
+		}
+	}
+	if cfg.PrivateKey, err = cfg.sealer.open(cfg.PrivateKey); err != nil {
+		return nil, fmt.Errorf("server private key: %w", err)
+	}
+
 	return cfg, nil
 }
 
@@ -57,7 +104,15 @@ func SaveConfig(cfg *Config) error {
 		return fmt.Errorf("ensure data dir: %w", err)
 	}
 
-	data, err := json.MarshalIndent(cfg, "", "  ")
+	// Seal a copy so cfg keeps the usable key.
+	out := *cfg
+	privKey, err := cfg.sealer.seal(cfg.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("seal private key: %w", err)
+	}
+	out.PrivateKey = privKey
+
+	data, err := json.MarshalIndent(&out, "", "  ")
 	if err != nil {
 		return fmt.Errorf("marshal config: %w", err)
 	}
@@ -2,10 +2,12 @@ package main
 
 import (
 	"crypto/rand"
+	"crypto/subtle"
 	"database/sql"
 	"encoding/base64"
+	"encoding/binary"
 	"fmt"
-	"net"
+	"net/netip"
 	"strings"
 
 	"golang.org/x/crypto/curve25519"
@@ -26,6 +28,29 @@ func generateKeyPair() (privateKey, publicKey string, err error) {
 		base64.StdEncoding.EncodeToString(pubKey[:]), nil
 }
 
+// validatePublicKey checks that key is a base64-encoded 32-byte Curve25519
+// public key, as printed by `wg pubkey`.
+func validatePublicKey(key string) error {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(raw) != curve25519.PointSize {
+		return errInvalidPublicKey
+	}
+	var zero [curve25519.PointSize]byte
+	if subtle.ConstantTimeCompare(raw, zero[:]) == 1 {
+		return errInvalidPublicKey
+	}
+	return nil
+}
+
+// generatePresharedKey returns a random 256-bit key, as `wg genpsk` does.
+func generatePresharedKey() (string, error) {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return "", fmt.Errorf("generate preshared key: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(key[:]), nil
+}
+
 func generateID() (string, error) {
 	b := make([]byte, 8)
 	if _, err := rand.Read(b); err != nil {
@@ -34,42 +59,195 @@ func generateID() (string, error) {
 	return fmt.Sprintf("%x", b), nil
 }
 
-// allocateIPTx allocates the next available IP using the provided CIDR.
-func allocateIPTx(tx *sql.Tx, cidr string) (string, error) {
-	ip, ipNet, err := net.ParseCIDR(cidr)
+// ipAllocation is a peer's slot in the address pool. Offset is the host
+// number within the pool; IP6 shares it so both families line up
+// (10.0.0.5 and fd00::5).
+type ipAllocation struct {
+	IP     string
+	IP6    string
+	Offset int64
+}
+
+// maxPoolHosts caps the usable range of very large (IPv6) prefixes so host
+// offsets fit in an SQLite INTEGER.
+const maxPoolHosts = 1 << 62
+
+// allocateIPTx allocates the lowest free host in the prefix of cidr and, when
+// cidr6 is set, the matching host in the IPv6 prefix. Free slots are found
+// with an indexed gap query on ip_offset rather than by loading every peer.
+func allocateIPTx(tx *sql.Tx, cidr, cidr6 string) (ipAllocation, error) {
+	server, prefix, err := parsePool(cidr, false)
+	if err != nil {
+		return ipAllocation{}, err
+	}
+	first, last := poolRange(prefix)
+	reserved := map[int64]bool{hostOffset(prefix, server): true}
+
+	var prefix6 netip.Prefix
+	if cidr6 != "" {
+		var server6 netip.Addr
+		if server6, prefix6, err = parsePool(cidr6, true); err != nil {
+			return ipAllocation{}, err
+		}
+		_, last6 := poolRange(prefix6)
+		last = min(last, last6)
+		reserved[hostOffset(prefix6, server6)] = true
+	}
+
+	if err := backfillOffsetsTx(tx, prefix); err != nil {
+		return ipAllocation{}, err
+	}
+
+	for start := first; start <= last; {
+		offset, err := firstFreeOffsetTx(tx, start)
+		if err != nil {
+			return ipAllocation{}, err
+		}
+		if offset > last {
+			break
+		}
+		start = offset + 1
+		if reserved[offset] {
+			continue
+		}
+
+		alloc := ipAllocation{IP: hostAddr(prefix, offset).String(), Offset: offset}
+		if prefix6.IsValid() {
+			alloc.IP6 = hostAddr(prefix6, offset).String()
+		}
+		// Addresses assigned before ip_offset existed may not line up with
+		// their offset, so make sure neither address is already taken.
+		var taken int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM peers WHERE allowed_ip = ? OR allowed_ip6 = ?",
+			alloc.IP+"/32", alloc.IP6+"/128").Scan(&taken); err != nil {
+			return ipAllocation{}, err
+		}
+		if taken == 0 {
+			return alloc, nil
+		}
+	}
+
+	return ipAllocation{}, errPoolExhausted
+}
+
+// poolCapacity returns how many peers the pools can hold, taking the
+// smaller IPv6 range into account and leaving out the server address.
+func poolCapacity(cidr, cidr6 string) (int64, error) {
+	server, prefix, err := parsePool(cidr, false)
 	if err != nil {
-		return "", fmt.Errorf("parse cidr: %w", err)
-	}
-	baseIP := ip.Mask(ipNet.Mask)
-	if baseIP.To4() == nil {
-		return "", fmt.Errorf("unsupported ip family")
-	}
-
-	usedIPs := make(map[string]bool)
-	usedIPs[ip.String()] = true
-
-	rows, err := tx.Query("SELECT allowed_ip FROM peers")
-	if err == nil && rows != nil {
-		defer rows.Close()
-		for rows.Next() {
-			var allowedIP string
-			if err := rows.Scan(&allowedIP); err != nil {
-				continue
-			}
-			peerIP := strings.TrimSuffix(allowedIP, "/32")
-			usedIPs[peerIP] = true
+		return 0, err
+	}
+	first, last := poolRange(prefix)
+	reserved := map[int64]bool{hostOffset(prefix, server): true}
+	if cidr6 != "" {
+		server6, prefix6, err := parsePool(cidr6, true)
+		if err != nil {
+			return 0, err
+		}
+		_, last6 := poolRange(prefix6)
+		last = min(last, last6)
+		reserved[hostOffset(prefix6, server6)] = true
+	}
+	capacity := last - first + 1
+	for offset := range reserved {
+		if offset >= first && offset <= last {
+			capacity--
 		}
 	}
+	return max(capacity, 0), nil
+}
+
+// firstFreeOffsetTx returns the lowest offset >= start not held by a peer.
+func firstFreeOffsetTx(tx *sql.Tx, start int64) (int64, error) {
+	var offset int64
+	err := tx.QueryRow(`SELECT COALESCE(
+		(SELECT ? WHERE NOT EXISTS (SELECT 1 FROM peers WHERE ip_offset = ?)),
+		(SELECT MIN(p.ip_offset) + 1 FROM peers p WHERE p.ip_offset >= ?
+			AND NOT EXISTS (SELECT 1 FROM peers q WHERE q.ip_offset = p.ip_offset + 1))
+	)`, start, start, start).Scan(&offset)
+	if err != nil {
+		return 0, fmt.Errorf("find free ip: %w", err)
+	}
+	return offset, nil
+}
 
-	for i := 2; i < 255; i++ {
-		nextIP := make(net.IP, 4)
-		copy(nextIP, baseIP.To4())
-		nextIP[3] = byte(i)
+// backfillOffsetsTx derives ip_offset for peers created before the column
+// existed. It only touches rows where the offset is still NULL. Rows whose
+// address lies outside prefix, e.g. after the pool was changed, keep a NULL
+// offset and are read again on every allocation; allocateIPTx still checks
+// their addresses directly, so they are never handed out twice.
+func backfillOffsetsTx(tx *sql.Tx, prefix netip.Prefix) error {
+	rows, err := tx.Query("SELECT id, allowed_ip FROM peers WHERE ip_offset IS NULL")
+	if err != nil {
+		return fmt.Errorf("backfill ip offsets: %w", err)
+	}
+	offsets := make(map[string]int64)
+	for rows.Next() {
+		var id, allowedIP string
+		if err := rows.Scan(&id, &allowedIP); err != nil {
+			rows.Close()
+			return fmt.Errorf("backfill ip offsets: %w", err)
+		}
+		addr, err := netip.ParseAddr(strings.TrimSuffix(allowedIP, "/32"))
+		if err != nil || !prefix.Contains(addr) {
+			continue
+		}
+		offsets[id] = hostOffset(prefix, addr)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("backfill ip offsets: %w", err)
+	}
 
-		if !usedIPs[nextIP.String()] {
-			return nextIP.String(), nil
+	for id, offset := range offsets {
+		if _, err := tx.Exec("UPDATE peers SET ip_offset = ? WHERE id = ?", offset, id); err != nil {
+			return fmt.Errorf("backfill ip offsets: %w", err)
 		}
 	}
+	return nil
+}
+
+// poolRange returns the first and last usable host offsets of prefix. The
+// network address is never handed out, nor is the IPv4 broadcast address.
+func poolRange(prefix netip.Prefix) (first, last int64) {
+	hostBits := prefix.Addr().BitLen() - prefix.Bits()
+	if hostBits >= 62 {
+		return 1, maxPoolHosts - 1
+	}
+	size := int64(1) << hostBits
+	if prefix.Addr().Is4() {
+		return 1, size - 2
+	}
+	return 1, size - 1
+}
+
+// hostOffset returns addr's host number within prefix.
+func hostOffset(prefix netip.Prefix, addr netip.Addr) int64 {
+	base, a := prefix.Addr().As16(), addr.As16()
+	return int64(binary.BigEndian.Uint64(a[8:]) - binary.BigEndian.Uint64(base[8:]))
+}
+
+// hostAddr returns the address at the given host offset within prefix.
+func hostAddr(prefix netip.Prefix, offset int64) netip.Addr {
+	a := prefix.Addr().As16()
+	binary.BigEndian.PutUint64(a[8:], binary.BigEndian.Uint64(a[8:])+uint64(offset))
+	addr := netip.AddrFrom16(a)
+	if prefix.Addr().Is4() {
+		return addr.Unmap()
+	}
+	return addr
+}
 
-	return "", fmt.Errorf("no available ips")
+// parsePool parses a server address in CIDR form (e.g. 10.0.0.1/24) and
+// checks it belongs to the expected address family.
+func parsePool(cidr string, v6 bool) (netip.Addr, netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return netip.Addr{}, netip.Prefix{}, fmt.Errorf("parse cidr: %w", err)
+	}
+	server := prefix.Addr()
+	if server.Is4() == v6 || server.Is4In6() {
+		return netip.Addr{}, netip.Prefix{}, fmt.Errorf("unsupported ip family for %s", cidr)
+	}
+	return server, prefix.Masked(), nil
 }
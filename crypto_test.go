@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+func TestHostAddr(t *testing.T) {
+	tests := []struct {
+		prefix string
+		offset int64
+		want   string
+	}{
+		{"10.0.0.0/24", 1, "10.0.0.1"},
+		{"10.0.0.0/24", 254, "10.0.0.254"},
+		{"10.0.0.0/23", 256, "10.0.1.0"},
+		{"10.0.0.0/30", 2, "10.0.0.2"},
+		{"fd00::/64", 5, "fd00::5"},
+		{"fd00::/64", 0x10000, "fd00::1:0"},
+		{"fd00:0:0:1::/64", 1, "fd00:0:0:1::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			prefix := netip.MustParsePrefix(tt.prefix)
+			got := hostAddr(prefix, tt.offset)
+			if got.String() != tt.want {
+				t.Errorf("hostAddr(%d) = %s, want %s", tt.offset, got, tt.want)
+			}
+			if back := hostOffset(prefix, got); back != tt.offset {
+				t.Errorf("hostOffset(%s) = %d, want %d", got, back, tt.offset)
+			}
+		})
+	}
+}
+
+func TestAllocateIP(t *testing.T) {
+	type step struct {
+		remove string
+		add    string
+		// want is the new peer's addresses, "" when the pool is exhausted.
+		want, want6 string
+	}
+	tests := []struct {
+		name        string
+		cidr, cidr6 string
+		steps       []step
+	}{
+		{"/30 holds one peer", "10.0.0.1/30", "", []step{
+			{add: "a", want: "10.0.0.2"},
+			{add: "b"},
+		}},
+		{"/31 holds none", "10.0.0.0/31", "", []step{{add: "a"}}},
+		{"/32 holds none", "10.0.0.1/32", "", []step{{add: "a"}}},
+		{"server address skipped", "10.0.0.3/29", "", []step{
+			{add: "a", want: "10.0.0.1"},
+			{add: "b", want: "10.0.0.2"},
+			{add: "c", want: "10.0.0.4"},
+			{add: "d", want: "10.0.0.5"},
+			{add: "e", want: "10.0.0.6"},
+			{add: "f"},
+		}},
+		{"gap after removal", "10.0.0.1/24", "", []step{
+			{add: "a", want: "10.0.0.2"},
+			{add: "b", want: "10.0.0.3"},
+			{add: "c", want: "10.0.0.4"},
+			{remove: "b"},
+			{add: "d", want: "10.0.0.3"},
+			{add: "e", want: "10.0.0.5"},
+		}},
+		{"IPv6 offsets", "10.0.0.1/24", "fd00::1/64", []step{
+			{add: "a", want: "10.0.0.2", want6: "fd00::2"},
+			{add: "b", want: "10.0.0.3", want6: "fd00::3"},
+		}},
+		{"smaller IPv6 pool", "10.0.0.1/24", "fd00::1/126", []step{
+			{add: "a", want: "10.0.0.2", want6: "fd00::2"},
+			{add: "b", want: "10.0.0.3", want6: "fd00::3"},
+			{add: "c"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := NewStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+
+			for _, s := range tt.steps {
+				if s.remove != "" {
+					if err := store.RemovePeer(s.remove); err != nil {
+						t.Fatal(err)
+					}
+					continue
+				}
+				peer, err := store.CreatePeer(s.add, tt.cidr, tt.cidr6, PeerOptions{})
+				if s.want == "" {
+					if !errors.Is(err, errPoolExhausted) {
+						t.Errorf("add %s: error = %v, want %v", s.add, err, errPoolExhausted)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("add %s: %v", s.add, err)
+				}
+				if peer.IP() != s.want || peer.IP6() != s.want6 {
+					t.Errorf("add %s: got %s %s, want %s %s", s.add, peer.IP(), peer.IP6(), s.want, s.want6)
+				}
+			}
+		})
+	}
+}
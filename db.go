@@ -2,9 +2,11 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -12,9 +14,26 @@ import (
 
 type Store struct {
 	db *sql.DB
+	// sealer encrypts private and preshared keys at rest; nil stores them
+	// in plaintext.
+	sealer *sealer
 }
 
+// NewStore opens the database in dir and brings its schema up to date.
 func NewStore(dir string) (*Store, error) {
+	s, err := openStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.Migrate(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// openStore opens the database without running migrations.
+func openStore(dir string) (*Store, error) {
 	if dir == "" {
 		dir = dataDir()
 	}
@@ -30,62 +49,48 @@ func NewStore(dir string) (*Store, error) {
 		return nil, fmt.Errorf("open db: %w", err)
 	}
 	db.SetMaxOpenConns(1)
-	_ = os.Chmod(dbPath, 0600)
-
-	if err := ensureSchema(db); err != nil {
+	if err := db.Ping(); err != nil {
 		db.Close()
-		return nil, err
+		return nil, fmt.Errorf("open db: %w", err)
 	}
+	_ = os.Chmod(dbPath, 0600)
 
 	return &Store{db: db}, nil
 }
 
-func ensureSchema(db *sql.DB) error {
-	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS peers (
-		id TEXT PRIMARY KEY,
-		name TEXT UNIQUE NOT NULL,
-		public_key TEXT UNIQUE NOT NULL,
-		private_key TEXT,
-		allowed_ip TEXT UNIQUE NOT NULL,
-		enabled INTEGER DEFAULT 1,
-		created_at DATETIME NOT NULL
-	)`); err != nil {
-		return fmt.Errorf("create peers table: %w", err)
-	}
-
-	rows, err := db.Query("PRAGMA table_info(peers)")
-	if err != nil {
-		return fmt.Errorf("table info: %w", err)
-	}
-	defer rows.Close()
-
-	hasPrivateKey := false
-	for rows.Next() {
-		var cid int
-		var colName, colType string
-		var notnull, dfltVal, pk interface{}
-		if err := rows.Scan(&cid, &colName, &colType, &notnull, &dfltVal, &pk); err != nil {
-			return fmt.Errorf("scan table info: %w", err)
-		}
-		if colName == "private_key" {
-			hasPrivateKey = true
-			break
-		}
-	}
-	if !hasPrivateKey {
-		if _, err := db.Exec("ALTER TABLE peers ADD COLUMN private_key TEXT"); err != nil {
-			return fmt.Errorf("migrate private_key: %w", err)
-		}
-	}
-
-	return nil
+func (s *Store) SetSealer(sl *sealer) {
+	s.sealer = sl
 }
 
 func (s *Store) Close() error {
 	return s.db.Close()
 }
 
-func (s *Store) CreatePeer(name, cidr string) (*Peer, error) {
+// PeerOptions are the optional settings of a new peer.
+type PeerOptions struct {
+	// PresharedKey adds a WireGuard preshared key to the peer.
+	PresharedKey bool
+	// PublicKey enrolls a client-generated key instead of generating a key
+	// pair; the private key then never reaches the server.
+	PublicKey string
+	// Routes overrides the server-wide client routes for this peer.
+	Routes []string
+	// SiteRoutes are LAN prefixes behind the peer that the server routes
+	// to it. They must not overlap the pool or other sites.
+	SiteRoutes []string
+	// Endpoint is the host:port other peers can reach this one at; it makes
+	// the peer a member of the mesh.
+	Endpoint string
+	// Group, if set, puts the new peer into an existing group.
+	Group string
+}
+
+// CreatePeer stores a new peer with the next free address from cidr and,
+// when set, cidr6. Unless opts.PublicKey is given, a key pair is generated.
+func (s *Store) CreatePeer(name, cidr, cidr6 string, opts PeerOptions) (*Peer, error) {
+	if err := validatePeerName(name); err != nil {
+		return nil, err
+	}
 	tx, err := s.db.Begin()
 	if err != nil {
 		return nil, err
@@ -101,13 +106,48 @@ func (s *Store) CreatePeer(name, cidr string) (*Peer, error) {
 		return nil, errPeerExists
 	}
 
-	privKey, pubKey, err := generateKeyPair()
-	if err != nil {
+	var privKey, pubKey string
+	if opts.PublicKey != "" {
+		if err := validatePublicKey(opts.PublicKey); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if err := tx.QueryRow("SELECT COUNT(*) FROM peers WHERE public_key = ?", opts.PublicKey).Scan(&exists); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if exists > 0 {
+			tx.Rollback()
+			return nil, errPublicKeyInUse
+		}
+		pubKey = opts.PublicKey
+	} else if privKey, pubKey, err = generateKeyPair(); err != nil {
 		tx.Rollback()
 		return nil, err
 	}
 
-	ip, err := allocateIPTx(tx, cidr)
+	if opts.Endpoint != "" {
+		if err := validateEndpoint(opts.Endpoint); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if err := checkSiteRoutesTx(tx, cidr, cidr6, opts.SiteRoutes); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if opts.Group != "" {
+		if err := tx.QueryRow("SELECT COUNT(*) FROM groups WHERE name = ?", opts.Group).Scan(&exists); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if exists == 0 {
+			tx.Rollback()
+			return nil, errGroupNotFound
+		}
+	}
+
+	alloc, err := allocateIPTx(tx, cidr, cidr6)
 	if err != nil {
 		tx.Rollback()
 		return nil, err
@@ -119,23 +159,62 @@ func (s *Store) CreatePeer(name, cidr string) (*Peer, error) {
 		return nil, err
 	}
 
+	var psk string
+	if opts.PresharedKey {
+		if psk, err = generatePresharedKey(); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
 	peer := &Peer{
-		ID:         id,
-		Name:       name,
-		PublicKey:  pubKey,
-		PrivateKey: privKey,
-		AllowedIP:  ip + "/32",
-		Enabled:    true,
-		CreatedAt:  time.Now(),
-	}
-
-	if _, err := tx.Exec(`INSERT INTO peers (id, name, public_key, private_key, allowed_ip, enabled, created_at) 
-		VALUES (?, ?, ?, ?, ?, ?, ?)`,
-		peer.ID, peer.Name, peer.PublicKey, peer.PrivateKey, peer.AllowedIP, peer.Enabled, peer.CreatedAt); err != nil {
+		ID:           id,
+		Name:         name,
+		PublicKey:    pubKey,
+		PrivateKey:   privKey,
+		PresharedKey: psk,
+		AllowedIP:    alloc.IP + "/32",
+		Routes:       opts.Routes,
+		SiteRoutes:   opts.SiteRoutes,
+		Endpoint:     opts.Endpoint,
+		Enabled:      true,
+		CreatedAt:    time.Now(),
+	}
+	if alloc.IP6 != "" {
+		peer.AllowedIP6 = alloc.IP6 + "/128"
+	}
+
+	sealedPrivKey, err := s.sealer.seal(peer.PrivateKey)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	sealedPSK, err := s.sealer.seal(peer.PresharedKey)
+	if err != nil {
 		tx.Rollback()
 		return nil, err
 	}
 
+	if _, err := tx.Exec(`INSERT INTO peers (id, name, public_key, private_key, preshared_key, allowed_ip, allowed_ip6, ip_offset, routes, site_routes, endpoint, enabled, created_at) 
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		peer.ID, peer.Name, peer.PublicKey, nullString(sealedPrivKey), nullString(sealedPSK), peer.AllowedIP, nullString(peer.AllowedIP6), alloc.Offset,
+		nullString(strings.Join(peer.Routes, ",")), nullString(strings.Join(peer.SiteRoutes, ",")), nullString(peer.Endpoint), peer.Enabled, peer.CreatedAt); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if opts.Group != "" {
+		if _, err := tx.Exec("INSERT INTO peer_groups (peer_id, group_name) VALUES (?, ?)", peer.ID, opts.Group); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if peer.IsMesh() {
+		if err := bumpMeshGenerationTx(tx); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
 	if err := tx.Commit(); err != nil {
 		tx.Rollback()
 		return nil, err
@@ -144,8 +223,124 @@ func (s *Store) CreatePeer(name, cidr string) (*Peer, error) {
 	return peer, nil
 }
 
+// RemovePeer deletes the peer. Its recorded usage is kept for billing and
+// stays available under its name through removed_peers.
 func (s *Store) RemovePeer(name string) error {
-	result, err := s.db.Exec("DELETE FROM peers WHERE name = ?", name)
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := bumpMeshIfMemberTx(tx, name); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO removed_peers (id, name, removed_at) SELECT id, name, ? FROM peers WHERE name = ?",
+		time.Now().Unix(), name); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM peer_counters WHERE peer_id IN (SELECT id FROM peers WHERE name = ?)", name); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM peer_groups WHERE peer_id IN (SELECT id FROM peers WHERE name = ?)", name); err != nil {
+		return err
+	}
+	result, err := tx.Exec("DELETE FROM peers WHERE name = ?", name)
+	if err != nil {
+		return err
+	}
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return errPeerNotFound
+	}
+	return tx.Commit()
+}
+
+func (s *Store) SetPeerEnabled(name string, enabled bool) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Only a peer that changes state moves the mesh along.
+	var current bool
+	if err := tx.QueryRow("SELECT enabled FROM peers WHERE name = ?", name).Scan(&current); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errPeerNotFound
+		}
+		return err
+	}
+	if current == enabled {
+		return nil
+	}
+	// A mesh peer leaves the mesh before it is disabled and joins it once
+	// it is enabled.
+	if !enabled {
+		if err := bumpMeshIfMemberTx(tx, name); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("UPDATE peers SET enabled = ? WHERE name = ?", enabled, name); err != nil {
+		return err
+	}
+	if enabled {
+		if err := bumpMeshIfMemberTx(tx, name); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// peerSelectColumns lists the columns scanPeer expects, in order.
+const peerSelectColumns = "id, name, public_key, private_key, preshared_key, allowed_ip, allowed_ip6, routes, site_routes, endpoint, enabled, created_at"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func (s *Store) scanPeer(row rowScanner) (Peer, error) {
+	var p Peer
+	var privKey, psk, ip6, routes, siteRoutes, endpoint sql.NullString
+	if err := row.Scan(&p.ID, &p.Name, &p.PublicKey, &privKey, &psk, &p.AllowedIP, &ip6, &routes, &siteRoutes, &endpoint, &p.Enabled, &p.CreatedAt); err != nil {
+		return Peer{}, err
+	}
+	var err error
+	if p.PrivateKey, err = s.sealer.open(privKey.String); err != nil {
+		return Peer{}, fmt.Errorf("peer %s: %w", p.Name, err)
+	}
+	if p.PresharedKey, err = s.sealer.open(psk.String); err != nil {
+		return Peer{}, fmt.Errorf("peer %s: %w", p.Name, err)
+	}
+	p.AllowedIP6 = ip6.String
+	p.Endpoint = endpoint.String
+	if routes.String != "" {
+		p.Routes = strings.Split(routes.String, ",")
+	}
+	if siteRoutes.String != "" {
+		p.SiteRoutes = strings.Split(siteRoutes.String, ",")
+	}
+	return p, nil
+}
+
+func (s *Store) GetPeer(name string) (*Peer, error) {
+	p, err := s.scanPeer(s.db.QueryRow("SELECT "+peerSelectColumns+" FROM peers WHERE name = ?", name))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errPeerNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// SetPresharedKey replaces the peer's preshared key; an empty key removes it.
+func (s *Store) SetPresharedKey(name, psk string) error {
+	sealed, err := s.sealer.seal(psk)
+	if err != nil {
+		return err
+	}
+	result, err := s.db.Exec("UPDATE peers SET preshared_key = ? WHERE name = ?", nullString(sealed), name)
 	if err != nil {
 		return err
 	}
@@ -156,8 +351,22 @@ func (s *Store) RemovePeer(name string) error {
 	return nil
 }
 
+func (s *Store) CountPeers() (int64, error) {
+	var n int64
+	err := s.db.QueryRow("SELECT COUNT(*) FROM peers").Scan(&n)
+	return n, err
+}
+
 func (s *Store) ListPeers() ([]Peer, error) {
-	rows, err := s.db.Query("SELECT id, name, public_key, private_key, allowed_ip, enabled, created_at FROM peers ORDER BY created_at")
+	return s.queryPeers("SELECT " + peerSelectColumns + " FROM peers ORDER BY created_at")
+}
+
+func (s *Store) EnabledPeers() ([]Peer, error) {
+	return s.queryPeers("SELECT " + peerSelectColumns + " FROM peers WHERE enabled = 1 ORDER BY created_at")
+}
+
+func (s *Store) queryPeers(query string, args ...interface{}) ([]Peer, error) {
+	rows, err := s.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -165,30 +374,120 @@ func (s *Store) ListPeers() ([]Peer, error) {
 
 	var peers []Peer
 	for rows.Next() {
-		var p Peer
-		if err := rows.Scan(&p.ID, &p.Name, &p.PublicKey, &p.PrivateKey, &p.AllowedIP, &p.Enabled, &p.CreatedAt); err != nil {
+		p, err := s.scanPeer(rows)
+		if err != nil {
 			return nil, err
 		}
 		peers = append(peers, p)
 	}
-
 	return peers, rows.Err()
 }
 
-func (s *Store) EnabledPeers() ([]Peer, error) {
-	rows, err := s.db.Query("SELECT public_key, allowed_ip FROM peers WHERE enabled = 1")
+// ResealSecrets re-encrypts every private and preshared key with next,
+// including keys still stored in plaintext, and switches the store over to
+// it. beforeCommit runs inside the transaction, so the new data key can be
+// persisted before the rows that depend on it are committed; if it fails,
+// nothing changes.
+func (s *Store) ResealSecrets(next *sealer, beforeCommit func() error) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	type secrets struct{ privKey, psk string }
+	all := make(map[string]secrets)
+	rows, err := tx.Query("SELECT id, private_key, preshared_key FROM peers")
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var id string
+		var privKey, psk sql.NullString
+		if err := rows.Scan(&id, &privKey, &psk); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		all[id] = secrets{privKey.String, psk.String}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for id, sec := range all {
+		var privKey, psk string
+		if privKey, err = s.sealer.open(sec.privKey); err != nil {
+			return 0, err
+		}
+		if psk, err = s.sealer.open(sec.psk); err != nil {
+			return 0, err
+		}
+		if privKey, err = next.seal(privKey); err != nil {
+			return 0, err
+		}
+		if psk, err = next.seal(psk); err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec("UPDATE peers SET private_key = ?, preshared_key = ? WHERE id = ?",
+			nullString(privKey), nullString(psk), id); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := beforeCommit(); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	s.sealer = next
+	return len(all), nil
+}
+
+// SyncStat is the number of times an operation (up or sync) ended with a
+// result (success or failure), and when it last did.
+type SyncStat struct {
+	Operation string
+	Result    string
+	Count     int64
+	LastAt    time.Time
+}
+
+// RecordSync counts the outcome of an up or sync.
+func (s *Store) RecordSync(operation string, syncErr error) error {
+	result := "success"
+	if syncErr != nil {
+		result = "failure"
+	}
+	_, err := s.db.Exec(`INSERT INTO sync_events (operation, result, count, last_at) VALUES (?, ?, 1, ?)
+		ON CONFLICT(operation, result) DO UPDATE SET count = count + 1, last_at = excluded.last_at`,
+		operation, result, time.Now().Unix())
+	return err
+}
+
+func (s *Store) SyncStats() ([]SyncStat, error) {
+	rows, err := s.db.Query("SELECT operation, result, count, last_at FROM sync_events ORDER BY operation, result")
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var peers []Peer
+	var stats []SyncStat
 	for rows.Next() {
-		var p Peer
-		if err := rows.Scan(&p.PublicKey, &p.AllowedIP); err != nil {
+		var st SyncStat
+		var lastAt int64
+		if err := rows.Scan(&st.Operation, &st.Result, &st.Count, &lastAt); err != nil {
 			return nil, err
 		}
-		peers = append(peers, p)
+		st.LastAt = time.Unix(lastAt, 0)
+		stats = append(stats, st)
 	}
-	return peers, rows.Err()
+	return stats, rows.Err()
+}
+
+// nullString stores empty strings as NULL so optional UNIQUE columns don't
+// collide on "".
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
 }
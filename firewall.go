@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// The firewall (forwarding, NAT and the group policies) is compiled into
+// shell commands so that wg-quick can run them as PostUp/PostDown and the
+// netlink backend as hooks. Config.Firewall picks the tool:
+//
+// With iptables, forwarded traffic from the interface passes a dispatcher
+// chain (vpn-<iface>) that sends each grouped peer's source address to its
+// group chains (vpn-<iface>-<group>), which accept what the policies allow,
+// and drops the rest. Ungrouped peers fall through to the blanket FORWARD
+// rule. The chains are loaded with iptables-restore, which swaps them in
+// one transaction.
+//
+// With nftables, everything lives in one table (inet vpn-<iface>) that is
+// replaced in a single transaction, so a sync never leaves the interface
+// half filtered.
+
+// firewallRules are the commands that install the firewall on up, replace
+// it on sync and remove it on down. %i stands for the interface.
+type firewallRules struct {
+	Up   []string
+	Sync []string
+	Down []string
+}
+
+// iptablesChainMax is the longest chain name iptables accepts.
+const iptablesChainMax = 28
+
+// compileFirewall turns the NAT settings, groups and policies into
+// firewall commands for the enabled peers. It is Linux only; desiredState
+// does not call it elsewhere, so macOS gets none.
+func compileFirewall(cfg *Config, peers []Peer, groups []Group, policies []Policy) (firewallRules, error) {
+	memberOf := make(map[string][]string)
+	for _, g := range groups {
+		for _, member := range g.Members {
+			memberOf[member] = append(memberOf[member], g.Name)
+		}
+	}
+	byGroup := make(map[string][]Policy)
+	for _, p := range policies {
+		byGroup[p.Group] = append(byGroup[p.Group], p)
+	}
+
+	switch cfg.Firewall {
+	case "", firewallIPTables:
+		return compileIPTables(cfg, peers, groups, memberOf, byGroup)
+	case firewallNFTables:
+		return compileNFTables(cfg, peers, groups, memberOf, byGroup), nil
+	default:
+		return firewallRules{}, fmt.Errorf("unknown firewall %q", cfg.Firewall)
+	}
+}
+
+// firewallTeardown returns the commands that remove the firewall. They do
+// nothing when it is not installed, so they are safe to run on every down.
+func firewallTeardown(cfg *Config) []string {
+	switch cfg.Firewall {
+	case "", firewallIPTables:
+		_, natDown := natRules(cfg)
+		return append(iptablesGroupTeardown(cfg), natDown...)
+	case firewallNFTables:
+		return []string{nftTeardown(cfg)}
+	default:
+		return nil
+	}
+}
+
+// natRules returns the iptables commands that enable forwarding and NAT
+// for the interface.
+func natRules(cfg *Config) (up, down []string) {
+	if cfg.NATInterface == "" {
+		return nil, nil
+	}
+	for _, bin := range iptablesTools(cfg) {
+		up = append(up,
+			fmt.Sprintf("%s -A FORWARD -i %%i -j ACCEPT", bin),
+			fmt.Sprintf("%s -t nat -A POSTROUTING -o %s -j MASQUERADE", bin, cfg.NATInterface))
+		down = append(down,
+			fmt.Sprintf("%s -D FORWARD -i %%i -j ACCEPT", bin),
+			fmt.Sprintf("%s -t nat -D POSTROUTING -o %s -j MASQUERADE", bin, cfg.NATInterface))
+	}
+	return up, down
+}
+
+func compileIPTables(cfg *Config, peers []Peer, groups []Group, memberOf map[string][]string, byGroup map[string][]Policy) (firewallRules, error) {
+	tools := iptablesTools(cfg)
+	dispatch := "vpn-" + cfg.Interface
+	natUp, natDown := natRules(cfg)
+	if len(groups) == 0 {
+		// Nothing to enforce; sync still removes chains left over from
+		// groups that were deleted while the interface ran.
+		return firewallRules{Up: natUp, Sync: iptablesGroupTeardown(cfg), Down: natDown}, nil
+	}
+
+	for _, g := range groups {
+		if len(dispatch)+1+len(g.Name) > iptablesChainMax {
+			return firewallRules{}, fmt.Errorf("group %s: chain name %s-%s is too long for iptables", g.Name, dispatch, g.Name)
+		}
+	}
+
+	rules := firewallRules{Up: natUp}
+	for _, bin := range tools {
+		v6 := bin == "ip6tables"
+		chains := []string{dispatch}
+		lines := []string{"-A " + dispatch + " -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT"}
+		for _, g := range groups {
+			chain := dispatch + "-" + g.Name
+			chains = append(chains, chain)
+			for _, p := range byGroup[g.Name] {
+				if rule, ok := iptablesPolicyRule(chain, p, v6); ok {
+					lines = append(lines, rule)
+				}
+			}
+		}
+		for _, peer := range peers {
+			names := memberOf[peer.Name]
+			if len(names) == 0 {
+				continue
+			}
+			addr := peer.AllowedIP
+			if v6 {
+				addr = peer.AllowedIP6
+			}
+			if addr == "" {
+				continue
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				lines = append(lines, fmt.Sprintf("-A %s -s %s -j %s-%s", dispatch, addr, dispatch, name))
+			}
+			lines = append(lines, fmt.Sprintf("-A %s -s %s -j DROP", dispatch, addr))
+		}
+
+		setup := []string{
+			iptablesRestore(bin, dispatch, chains, lines),
+			fmt.Sprintf("%s -C FORWARD -i %%i -j %s 2>/dev/null || %s -I FORWARD -i %%i -j %s", bin, dispatch, bin, dispatch),
+		}
+		rules.Up = append(rules.Up, setup...)
+		rules.Sync = append(rules.Sync, setup...)
+	}
+	rules.Down = append(iptablesGroupTeardown(cfg), natDown...)
+	return rules, nil
+}
+
+// iptablesRestore loads the dispatcher and group chains in one
+// iptables-restore transaction, so a sync switches from the old rules to
+// the new ones without a moment in which grouped peers are unfiltered.
+// Declaring a chain creates or flushes it; group chains that are not
+// declared, left over from deleted groups, are found with -S and dropped
+// in the same transaction.
+func iptablesRestore(bin, dispatch string, chains, rules []string) string {
+	var declare, stale []string
+	for _, c := range chains {
+		declare = append(declare, shellQuote(":"+c+" - [0:0]"))
+		stale = append(stale, "-e "+c)
+	}
+	var body []string
+	for _, r := range rules {
+		body = append(body, shellQuote(r))
+	}
+	return fmt.Sprintf("{ printf '%%s\\n' '*filter' %s; "+
+		"%s -S | sed -n 's/^-N \\(%s-[^ ]*\\)$/\\1/p' | grep -vxF %s | while read c; do printf ':%%s - [0:0]\\n-X %%s\\n' \"$c\" \"$c\"; done; "+
+		"printf '%%s\\n' %s COMMIT; } | %s-restore --noflush",
+		strings.Join(declare, " "), bin, dispatch, strings.Join(stale, " "), strings.Join(body, " "), bin)
+}
+
+// shellQuote wraps s in single quotes for sh. The rules contain none
+// themselves: names, prefixes and ports are validated before they are
+// stored.
+func shellQuote(s string) string {
+	return "'" + s + "'"
+}
+
+// iptablesGroupTeardown removes the dispatcher and group chains, if any.
+func iptablesGroupTeardown(cfg *Config) []string {
+	var cmds []string
+	for _, bin := range iptablesTools(cfg) {
+		cmds = append(cmds, iptablesTeardown(bin, "vpn-"+cfg.Interface))
+	}
+	return cmds
+}
+
+func iptablesTools(cfg *Config) []string {
+	if cfg.Address6 != "" {
+		return []string{"iptables", "ip6tables"}
+	}
+	return []string{"iptables"}
+}
+
+// iptablesPolicyRule renders one policy as an ACCEPT rule in chain, in
+// iptables-restore form. It reports false for policies whose destination
+// is of the other family.
+func iptablesPolicyRule(chain string, p Policy, v6 bool) (string, bool) {
+	args := []string{"-A", chain}
+	if p.Destination != "any" {
+		prefix, err := netip.ParsePrefix(p.Destination)
+		if err != nil || prefix.Addr().Is6() != v6 {
+			return "", false
+		}
+		args = append(args, "-d", prefix.String())
+	}
+	if p.Protocol != protoAny {
+		args = append(args, "-p", p.Protocol)
+	}
+	if p.Port != "" {
+		args = append(args, "--dport", strings.ReplaceAll(p.Port, "-", ":"))
+	}
+	args = append(args, "-j", "ACCEPT")
+	return strings.Join(args, " "), true
+}
+
+// deleteGroupChains flushes and deletes every group chain of the
+// interface, including those of groups that no longer exist.
+func deleteGroupChains(bin, dispatch string) string {
+	return fmt.Sprintf("for c in $(%s -S | sed -n 's/^-N \\(%s-[^ ]*\\)$/\\1/p'); do %s -F $c; %s -X $c; done",
+		bin, dispatch, bin, bin)
+}
+
+// iptablesTeardown removes the dispatcher and group chains if present.
+func iptablesTeardown(bin, dispatch string) string {
+	return fmt.Sprintf("if %s -L %s >/dev/null 2>&1; then %s -D FORWARD -i %%i -j %s; %s -F %s; %s; %s -X %s; fi",
+		bin, dispatch, bin, dispatch, bin, dispatch, deleteGroupChains(bin, dispatch), bin, dispatch)
+}
+
+// State is what a Backend applies: the enabled peers and the firewall
+// compiled from their groups. AppliedRoutes are the site prefixes an
+// earlier sync routed to the interface; only those are removed when their
+// sites are gone.
+type State struct {
+	Peers         []Peer
+	Firewall      firewallRules
+	AppliedRoutes []netip.Prefix
+}
+
+// desiredState loads the enabled peers and compiles the firewall for them.
+func (m *Manager) desiredState() (State, error) {
+	peers, err := m.store.EnabledPeers()
+	if err != nil {
+		return State{}, err
+	}
+	groups, err := m.store.ListGroups()
+	if err != nil {
+		return State{}, err
+	}
+	policies, err := m.store.ListPolicies("")
+	if err != nil {
+		return State{}, err
+	}
+	var fw firewallRules
+	if runtime.GOOS == "linux" {
+		if fw, err = compileFirewall(m.cfg, peers, groups, policies); err != nil {
+			return State{}, err
+		}
+	}
+	applied, err := m.store.AppliedRoutes()
+	if err != nil {
+		return State{}, err
+	}
+	return State{Peers: peers, Firewall: fw, AppliedRoutes: applied}, nil
+}
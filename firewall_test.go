@@ -0,0 +1,141 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompileFirewallChainNameTooLong(t *testing.T) {
+	tests := []struct {
+		iface, group string
+		wantErr      bool
+	}{
+		{"wg0", "contractors", false},
+		// vpn-wg0- plus 20 characters is exactly iptablesChainMax.
+		{"wg0", "abcdefghijklmnopqrst", false},
+		{"wg0", "abcdefghijklmnopqrstu", true},
+		{"wg-office-tunnel", "contractors", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.iface+"/"+tt.group, func(t *testing.T) {
+			cfg := &Config{Interface: tt.iface, Address: "10.0.0.1/24"}
+			_, err := compileFirewall(cfg, nil, []Group{{Name: tt.group}}, nil)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCompileFirewallDispatcherOrder(t *testing.T) {
+	cfg := &Config{Interface: "wg0", Address: "10.0.0.1/24"}
+	peers := []Peer{
+		{Name: "alice", AllowedIP: "10.0.0.2/32"},
+		{Name: "bob", AllowedIP: "10.0.0.3/32"},
+		{Name: "carol", AllowedIP: "10.0.0.4/32"},
+	}
+	groups := []Group{
+		{Name: "ops", Members: []string{"alice"}},
+		{Name: "dev", Members: []string{"alice", "bob"}},
+	}
+	policies := []Policy{{Group: "dev", Destination: "10.20.0.0/16", Protocol: protoTCP, Port: "8000-8100"}}
+
+	rules, err := compileFirewall(cfg, peers, groups, policies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules.Sync) != 2 {
+		t.Fatalf("got %d sync commands, want restore and jump: %q", len(rules.Sync), rules.Sync)
+	}
+	restore, jump := rules.Sync[0], rules.Sync[1]
+	if !strings.HasSuffix(restore, "| iptables-restore --noflush") {
+		t.Errorf("first command does not load the chains with iptables-restore: %s", restore)
+	}
+	if !strings.Contains(jump, "-I FORWARD -i %i -j vpn-wg0") {
+		t.Errorf("second command does not hook the dispatcher into FORWARD: %s", jump)
+	}
+
+	// Chains are declared before any rule, established traffic is accepted
+	// first, and each grouped peer jumps to its groups in name order before
+	// being dropped. carol is in no group and is not matched at all.
+	inOrder := []string{
+		"':vpn-wg0 - [0:0]'",
+		"':vpn-wg0-ops - [0:0]'",
+		"':vpn-wg0-dev - [0:0]'",
+		"'-A vpn-wg0 -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT'",
+		"'-A vpn-wg0-dev -d 10.20.0.0/16 -p tcp --dport 8000:8100 -j ACCEPT'",
+		"'-A vpn-wg0 -s 10.0.0.2/32 -j vpn-wg0-dev'",
+		"'-A vpn-wg0 -s 10.0.0.2/32 -j vpn-wg0-ops'",
+		"'-A vpn-wg0 -s 10.0.0.2/32 -j DROP'",
+		"'-A vpn-wg0 -s 10.0.0.3/32 -j vpn-wg0-dev'",
+		"'-A vpn-wg0 -s 10.0.0.3/32 -j DROP'",
+		"COMMIT",
+	}
+	pos := 0
+	for _, want := range inOrder {
+		i := strings.Index(restore[pos:], want)
+		if i < 0 {
+			t.Fatalf("%s missing or out of order in:\n%s", want, restore)
+		}
+		pos += i + len(want)
+	}
+	if strings.Contains(restore, "10.0.0.4") {
+		t.Errorf("ungrouped peer carol is filtered:\n%s", restore)
+	}
+	if !strings.Contains(restore, "-e vpn-wg0-dev") {
+		t.Errorf("current group chains are not excluded from stale chain removal:\n%s", restore)
+	}
+}
+
+func TestCompileFirewallDualStack(t *testing.T) {
+	cfg := &Config{Interface: "wg0", Address: "10.0.0.1/24", Address6: "fd00::1/64"}
+	peers := []Peer{{Name: "alice", AllowedIP: "10.0.0.2/32", AllowedIP6: "fd00::2/128"}}
+	groups := []Group{{Name: "dev", Members: []string{"alice"}}}
+	policies := []Policy{
+		{Group: "dev", Destination: "10.20.0.0/16"},
+		{Group: "dev", Destination: "fd00:20::/48"},
+	}
+
+	rules, err := compileFirewall(cfg, peers, groups, policies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules.Sync) != 4 {
+		t.Fatalf("got %d sync commands, want restore and jump per family: %q", len(rules.Sync), rules.Sync)
+	}
+	v4, v6 := rules.Sync[0], rules.Sync[2]
+	if !strings.Contains(v4, "-d 10.20.0.0/16") || strings.Contains(v4, "fd00") {
+		t.Errorf("iptables rules should only hold IPv4 prefixes:\n%s", v4)
+	}
+	if !strings.HasSuffix(v6, "| ip6tables-restore --noflush") ||
+		!strings.Contains(v6, "-d fd00:20::/48") || !strings.Contains(v6, "-s fd00::2/128") || strings.Contains(v6, "10.") {
+		t.Errorf("ip6tables rules should only hold IPv6 prefixes:\n%s", v6)
+	}
+}
+
+func TestIPTablesPolicyRule(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy Policy
+		v6     bool
+		want   string
+		wantOK bool
+	}{
+		{"any", Policy{Destination: "any"}, false, "-A c -j ACCEPT", true},
+		{"any on IPv6", Policy{Destination: "any"}, true, "-A c -j ACCEPT", true},
+		{"prefix", Policy{Destination: "10.20.0.0/16"}, false, "-A c -d 10.20.0.0/16 -j ACCEPT", true},
+		{"port", Policy{Destination: "10.20.0.0/16", Protocol: protoTCP, Port: "443"}, false, "-A c -d 10.20.0.0/16 -p tcp --dport 443 -j ACCEPT", true},
+		{"port range", Policy{Destination: "any", Protocol: protoUDP, Port: "8000-8100"}, false, "-A c -p udp --dport 8000:8100 -j ACCEPT", true},
+		{"IPv6 prefix with port", Policy{Destination: "fd00:20::/48", Protocol: protoTCP, Port: "443"}, true, "-A c -d fd00:20::/48 -p tcp --dport 443 -j ACCEPT", true},
+		{"IPv6 prefix on IPv4", Policy{Destination: "fd00:20::/48"}, false, "", false},
+		{"IPv4 prefix on IPv6", Policy{Destination: "10.20.0.0/16"}, true, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := iptablesPolicyRule("c", tt.policy, tt.v6)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("got %q, %v; want %q, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Group is a named set of peers that share a firewall policy. Peers in no
+// group keep unrestricted forwarding; a peer in one or more groups may only
+// reach what its groups' policies allow.
+type Group struct {
+	Name      string    `json:"name"`
+	Members   []string  `json:"members"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Policy allows a group to reach a destination prefix, optionally only on
+// one protocol and port range.
+type Policy struct {
+	ID          int64  `json:"id"`
+	Group       string `json:"group"`
+	Destination string `json:"destination"`
+	Protocol    string `json:"protocol,omitempty"`
+	Port        string `json:"port,omitempty"`
+}
+
+const (
+	protoAny = ""
+	protoTCP = "tcp"
+	protoUDP = "udp"
+)
+
+var (
+	errGroupExists      = errors.New("group already exists")
+	errGroupNotFound    = errors.New("group not found")
+	errPolicyNotFound   = errors.New("policy not found")
+	errInvalidGroupName = errors.New("invalid group name: use up to 16 lowercase letters, digits, '-' or '_'")
+	errInvalidPolicy    = errors.New("invalid policy")
+)
+
+// groupNamePattern keeps names usable inside iptables chain and nftables
+// set names.
+var groupNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,15}$`)
+
+func validateGroupName(name string) error {
+	if !groupNamePattern.MatchString(name) {
+		return errInvalidGroupName
+	}
+	return nil
+}
+
+// String renders the policy target the way `vpn policy add` takes it.
+func (p Policy) String() string {
+	target := p.Destination
+	if p.Port != "" {
+		if strings.Contains(target, ":") {
+			target = "[" + target + "]"
+		}
+		target += ":" + p.Port
+	}
+	if p.Protocol != protoAny {
+		target += "/" + p.Protocol
+	}
+	return target
+}
+
+// parsePolicyTarget parses a policy target such as "10.20.5.0/24:443",
+// "10.20.5.0/24:8000-8100/udp", "[fd00:20::/48]:443" or "any". A port
+// without a protocol means TCP.
+func parsePolicyTarget(s string) (Policy, error) {
+	var p Policy
+	target := strings.TrimSpace(s)
+	if i := strings.LastIndex(target, "/"); i >= 0 {
+		switch proto := target[i+1:]; proto {
+		case protoTCP, protoUDP:
+			p.Protocol = proto
+			target = target[:i]
+		}
+	}
+
+	dest := target
+	if strings.HasPrefix(target, "[") {
+		host, port, err := net.SplitHostPort(target)
+		if err != nil {
+			return Policy{}, fmt.Errorf("%w %q: %v", errInvalidPolicy, s, err)
+		}
+		dest, p.Port = host, port
+	} else if strings.Count(target, ":") == 1 {
+		dest, p.Port, _ = strings.Cut(target, ":")
+	}
+
+	if dest == "any" {
+		p.Destination = dest
+	} else {
+		prefix, err := netip.ParsePrefix(dest)
+		if err != nil {
+			if addr, aerr := netip.ParseAddr(dest); aerr == nil {
+				prefix = netip.PrefixFrom(addr, addr.BitLen())
+			} else {
+				return Policy{}, fmt.Errorf("%w %q: destination must be a CIDR prefix, an address or \"any\"", errInvalidPolicy, s)
+			}
+		}
+		p.Destination = prefix.Masked().String()
+	}
+
+	if p.Port != "" {
+		if err := validatePortRange(p.Port); err != nil {
+			return Policy{}, fmt.Errorf("%w %q: %v", errInvalidPolicy, s, err)
+		}
+		if p.Protocol == protoAny {
+			p.Protocol = protoTCP
+		}
+	}
+	return p, nil
+}
+
+func validatePortRange(ports string) error {
+	lo, hi, isRange := strings.Cut(ports, "-")
+	first, err := strconv.Atoi(lo)
+	if err != nil || first < 1 || first > 65535 {
+		return fmt.Errorf("bad port %q", lo)
+	}
+	if !isRange {
+		return nil
+	}
+	last, err := strconv.Atoi(hi)
+	if err != nil || last < first || last > 65535 {
+		return fmt.Errorf("bad port range %q", ports)
+	}
+	return nil
+}
+
+func (s *Store) CreateGroup(name string) error {
+	if err := validateGroupName(name); err != nil {
+		return err
+	}
+	var exists int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM groups WHERE name = ?", name).Scan(&exists); err != nil {
+		return err
+	}
+	if exists > 0 {
+		return errGroupExists
+	}
+	_, err := s.db.Exec("INSERT INTO groups (name, created_at) VALUES (?, ?)", name, time.Now().Unix())
+	return err
+}
+
+// DeleteGroup removes the group with its memberships, policies and owners.
+func (s *Store) DeleteGroup(name string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM groups WHERE name = ?", name)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return errGroupNotFound
+	}
+	if _, err := tx.Exec("DELETE FROM peer_groups WHERE group_name = ?", name); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM policies WHERE group_name = ?", name); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM user_groups WHERE group_name = ?", name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ListGroups returns all groups with the names of their members.
+func (s *Store) ListGroups() ([]Group, error) {
+	rows, err := s.db.Query(`SELECT g.name, g.created_at, p.name FROM groups g
+		LEFT JOIN peer_groups pg ON pg.group_name = g.name
+		LEFT JOIN peers p ON p.id = pg.peer_id
+		ORDER BY g.name, p.name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := []Group{}
+	for rows.Next() {
+		var name string
+		var created int64
+		var member sql.NullString
+		if err := rows.Scan(&name, &created, &member); err != nil {
+			return nil, err
+		}
+		if len(groups) == 0 || groups[len(groups)-1].Name != name {
+			groups = append(groups, Group{Name: name, Members: []string{}, CreatedAt: time.Unix(created, 0)})
+		}
+		if member.Valid {
+			g := &groups[len(groups)-1]
+			g.Members = append(g.Members, member.String)
+		}
+	}
+	return groups, rows.Err()
+}
+
+// AddGroupMember puts the peer into the group; adding it twice is a no-op.
+func (s *Store) AddGroupMember(group, peerName string) error {
+	peerID, err := s.groupMemberIDs(group, peerName)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec("INSERT OR IGNORE INTO peer_groups (peer_id, group_name) VALUES (?, ?)", peerID, group)
+	return err
+}
+
+func (s *Store) RemoveGroupMember(group, peerName string) error {
+	peerID, err := s.groupMemberIDs(group, peerName)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec("DELETE FROM peer_groups WHERE peer_id = ? AND group_name = ?", peerID, group)
+	return err
+}
+
+// groupMemberIDs checks that both the group and the peer exist and returns
+// the peer's ID.
+func (s *Store) groupMemberIDs(group, peerName string) (string, error) {
+	var exists int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM groups WHERE name = ?", group).Scan(&exists); err != nil {
+		return "", err
+	}
+	if exists == 0 {
+		return "", errGroupNotFound
+	}
+	var peerID string
+	err := s.db.QueryRow("SELECT id FROM peers WHERE name = ?", peerName).Scan(&peerID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", errPeerNotFound
+	}
+	return peerID, err
+}
+
+func (s *Store) AddPolicy(p Policy) (int64, error) {
+	var exists int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM groups WHERE name = ?", p.Group).Scan(&exists); err != nil {
+		return 0, err
+	}
+	if exists == 0 {
+		return 0, errGroupNotFound
+	}
+	result, err := s.db.Exec("INSERT INTO policies (group_name, destination, protocol, port, created_at) VALUES (?, ?, ?, ?, ?)",
+		p.Group, p.Destination, p.Protocol, p.Port, time.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func (s *Store) RemovePolicy(id int64) error {
+	result, err := s.db.Exec("DELETE FROM policies WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return errPolicyNotFound
+	}
+	return nil
+}
+
+// ListPolicies returns the policies of group, or of all groups if group is
+// empty.
+func (s *Store) ListPolicies(group string) ([]Policy, error) {
+	query := "SELECT id, group_name, destination, protocol, port FROM policies"
+	var args []any
+	if group != "" {
+		query += " WHERE group_name = ?"
+		args = append(args, group)
+	}
+	rows, err := s.db.Query(query+" ORDER BY group_name, id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	policies := []Policy{}
+	for rows.Next() {
+		var p Policy
+		if err := rows.Scan(&p.ID, &p.Group, &p.Destination, &p.Protocol, &p.Port); err != nil {
+			return nil, err
+		}
+		policies = append(policies, p)
+	}
+	return policies, rows.Err()
+}
+
+func (m *Manager) CreateGroup(name string) error {
+	if err := m.require(roleAdmin); err != nil {
+		return err
+	}
+	return m.store.CreateGroup(name)
+}
+
+func (m *Manager) DeleteGroup(name string) error {
+	if err := m.require(roleAdmin); err != nil {
+		return err
+	}
+	return m.store.DeleteGroup(name)
+}
+
+func (m *Manager) ListGroups() ([]Group, error) {
+	return m.store.ListGroups()
+}
+
+func (m *Manager) AddGroupMember(group, peer string) error {
+	if err := m.require(roleAdmin); err != nil {
+		return err
+	}
+	return m.store.AddGroupMember(group, peer)
+}
+
+func (m *Manager) RemoveGroupMember(group, peer string) error {
+	if err := m.require(roleAdmin); err != nil {
+		return err
+	}
+	return m.store.RemoveGroupMember(group, peer)
+}
+
+func (m *Manager) AddPolicy(p Policy) (int64, error) {
+	if err := m.require(roleAdmin); err != nil {
+		return 0, err
+	}
+	return m.store.AddPolicy(p)
+}
+
+func (m *Manager) RemovePolicy(id int64) error {
+	if err := m.require(roleAdmin); err != nil {
+		return err
+	}
+	return m.store.RemovePolicy(id)
+}
+
+func (m *Manager) ListPolicies(group string) ([]Policy, error) {
+	return m.store.ListPolicies(group)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParsePolicyTarget(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Policy
+		wantErr bool
+	}{
+		{in: "any", want: Policy{Destination: "any"}},
+		{in: "any:53/udp", want: Policy{Destination: "any", Port: "53", Protocol: protoUDP}},
+		{in: "10.20.5.0/24", want: Policy{Destination: "10.20.5.0/24"}},
+		{in: "10.20.5.7", want: Policy{Destination: "10.20.5.7/32"}},
+		{in: "10.20.5.1/24", want: Policy{Destination: "10.20.5.0/24"}},
+		{in: "10.20.5.0/24:443", want: Policy{Destination: "10.20.5.0/24", Port: "443", Protocol: protoTCP}},
+		{in: "10.20.5.0/24:8000-8100/udp", want: Policy{Destination: "10.20.5.0/24", Port: "8000-8100", Protocol: protoUDP}},
+		{in: "10.20.5.0/24/udp", want: Policy{Destination: "10.20.5.0/24", Protocol: protoUDP}},
+		{in: "fd00:20::/48", want: Policy{Destination: "fd00:20::/48"}},
+		{in: "[fd00:20::/48]:443", want: Policy{Destination: "fd00:20::/48", Port: "443", Protocol: protoTCP}},
+		{in: "[fd00:20::1]:8000-8100/udp", want: Policy{Destination: "fd00:20::1/128", Port: "8000-8100", Protocol: protoUDP}},
+		{in: "10.20.5.0/24:0", wantErr: true},
+		{in: "10.20.5.0/24:70000", wantErr: true},
+		{in: "10.20.5.0/24:9000-8000", wantErr: true},
+		{in: "[fd00:20::/48", wantErr: true},
+		{in: "intranet", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parsePolicyTarget(tt.in)
+			if tt.wantErr {
+				if !errors.Is(err, errInvalidPolicy) {
+					t.Fatalf("err = %v, want errInvalidPolicy", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
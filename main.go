@@ -16,31 +16,76 @@ func main() {
 	// behavior explicit and make the control flow easy to follow.
 	switch cmd {
 	case "init":
-		cmdInit()
+		cmdInit(os.Args[2:])
 	case "up":
-		cmdUp()
+		cmdUp(os.Args[2:])
 	case "down":
 		cmdDown()
 	case "add":
 		if len(os.Args) < 3 {
-			fatal("Usage: vpn add <peer-name>")
+			fatal("Usage: vpn add <peer-name> [--psk] [--pubkey <key>] [--routes <cidrs>] [--site <cidrs>] [--endpoint <host:port>]")
 		}
-		cmdAddPeer(os.Args[2])
+		cmdAddPeer(os.Args[2], os.Args[3:])
 	case "remove", "rm":
 		if len(os.Args) < 3 {
 			fatal("Usage: vpn remove <peer-name>")
 		}
 		cmdRemovePeer(os.Args[2])
+	case "enable":
+		if len(os.Args) < 3 {
+			fatal("Usage: vpn enable <peer-name>")
+		}
+		cmdSetPeerEnabled(os.Args[2], true)
+	case "disable":
+		if len(os.Args) < 3 {
+			fatal("Usage: vpn disable <peer-name>")
+		}
+		cmdSetPeerEnabled(os.Args[2], false)
+	case "psk":
+		if len(os.Args) < 4 || os.Args[2] != "rotate" {
+			fatal("Usage: vpn psk rotate <peer-name>")
+		}
+		cmdRotatePSK(os.Args[3])
+	case "config":
+		if len(os.Args) < 3 {
+			fatal("Usage: vpn config <peer-name>")
+		}
+		cmdShowConfig(os.Args[2])
+	case "mesh":
+		if len(os.Args) < 4 || os.Args[2] != "export" {
+			fatal("Usage: vpn mesh export <peer-name>")
+		}
+		cmdMeshExport(os.Args[3])
+	case "group":
+		cmdGroup(os.Args[2:])
+	case "policy":
+		cmdPolicy(os.Args[2:])
+	case "token":
+		cmdToken(os.Args[2:])
+	case "user":
+		cmdUser(os.Args[2:])
 	case "list", "ls":
 		cmdListPeers()
 	case "sync":
-		cmdSync()
-	case "web":
-		port := "8080"
-		if len(os.Args) > 2 {
-			port = os.Args[2]
+		cmdSync(os.Args[2:])
+	case "usage":
+		if len(os.Args) < 3 {
+			fatal("Usage: vpn usage <peer-name> [--since 30d] [--by day|hour] [--json]")
+		}
+		cmdUsage(os.Args[2], os.Args[3:])
+	case "collect":
+		cmdCollect(os.Args[2:])
+	case "agent":
+		cmdAgent(os.Args[2:])
+	case "db":
+		if len(os.Args) < 3 || os.Args[2] != "migrate" {
+			fatal("Usage: vpn db migrate [--status]")
 		}
-		cmdWeb(port)
+		cmdMigrate(os.Args[3:])
+	case "rekey-storage":
+		cmdRekeyStorage(os.Args[2:])
+	case "web":
+		cmdWeb(os.Args[2:])
 	default:
 		printUsage()
 		os.Exit(1)
@@ -1,20 +1,101 @@
 package main
 
+import (
+	"fmt"
+	"log"
+	"slices"
+)
+
 type Manager struct {
-	cfg   *Config
-	store *Store
+	cfg     *Config
+	store   *Store
+	backend Backend
+	// user is who the Manager acts for; see As.
+	user *User
+}
+
+func NewManager(cfg *Config, store *Store, backend Backend) *Manager {
+	return &Manager{cfg: cfg, store: store, backend: backend}
+}
+
+// SyncResult reports whether auto_sync pushed a change to the running
+// interface.
+type SyncResult struct {
+	Applied bool   `json:"applied"`
+	Error   string `json:"error,omitempty"`
 }
 
-func NewManager(cfg *Config, store *Store) *Manager {
-	return &Manager{cfg: cfg, store: store}
+// AddPeer stores a new peer. With auto_sync it is also applied to the
+// running interface; the result is nil when auto_sync is off.
+func (m *Manager) AddPeer(name string, opts PeerOptions) (*Peer, *SyncResult, error) {
+	if err := m.requireNewPeerGroup(&opts); err != nil {
+		return nil, nil, err
+	}
+	if m.cfg.PresharedKeys {
+		opts.PresharedKey = true
+	}
+	peer, err := m.store.CreatePeer(name, m.cfg.Address, m.cfg.Address6, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return peer, m.autoSync(), nil
 }
 
-func (m *Manager) AddPeer(name string) (*Peer, error) {
-	return m.store.CreatePeer(name, m.cfg.Address)
+// RotatePresharedKey gives the peer a new preshared key and returns the
+// updated peer; with auto_sync the key is also applied. The client needs
+// the new config before it can reconnect.
+func (m *Manager) RotatePresharedKey(name string) (*Peer, *SyncResult, error) {
+	if err := m.requirePeer(name); err != nil {
+		return nil, nil, err
+	}
+	psk, err := generatePresharedKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := m.store.SetPresharedKey(name, psk); err != nil {
+		return nil, nil, err
+	}
+	peer, err := m.store.GetPeer(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return peer, m.autoSync(), nil
+}
+
+// RemovePeer deletes a peer and, with auto_sync, removes it from the
+// running interface.
+func (m *Manager) RemovePeer(name string) (*SyncResult, error) {
+	if err := m.requirePeer(name); err != nil {
+		return nil, err
+	}
+	if err := m.store.RemovePeer(name); err != nil {
+		return nil, err
+	}
+	return m.autoSync(), nil
 }
 
-func (m *Manager) RemovePeer(name string) error {
-	return m.store.RemovePeer(name)
+func (m *Manager) EnablePeer(name string) (*SyncResult, error) {
+	return m.setPeerEnabled(name, true)
+}
+
+func (m *Manager) DisablePeer(name string) (*SyncResult, error) {
+	return m.setPeerEnabled(name, false)
+}
+
+// setPeerEnabled stores the peer's state and, with auto_sync, applies it
+// to the running interface.
+func (m *Manager) setPeerEnabled(name string, enabled bool) (*SyncResult, error) {
+	if err := m.requirePeer(name); err != nil {
+		return nil, err
+	}
+	if err := m.store.SetPeerEnabled(name, enabled); err != nil {
+		return nil, err
+	}
+	return m.autoSync(), nil
+}
+
+func (m *Manager) GetPeer(name string) (*Peer, error) {
+	return m.store.GetPeer(name)
 }
 
 func (m *Manager) ListPeers() ([]Peer, error) {
@@ -25,16 +106,158 @@ func (m *Manager) EnabledPeers() ([]Peer, error) {
 	return m.store.EnabledPeers()
 }
 
+// Up brings the interface up with the enabled peers.
+func (m *Manager) Up() error {
+	err := m.up()
+	m.recordSync("up", err)
+	return err
+}
+
+func (m *Manager) up() error {
+	if err := m.require(roleAdmin); err != nil {
+		return err
+	}
+	state, err := m.desiredState()
+	if err != nil {
+		return err
+	}
+	return m.applyState(state, m.backend.Up)
+}
+
+func (m *Manager) Down() error {
+	if err := m.require(roleAdmin); err != nil {
+		return err
+	}
+	return m.backend.Down()
+}
+
+// Sync applies the enabled peers to the running interface.
+func (m *Manager) Sync() error {
+	if err := m.require(roleOperator); err != nil {
+		return err
+	}
+	err := m.sync()
+	m.recordSync("sync", err)
+	return err
+}
+
+func (m *Manager) sync() error {
+	state, err := m.desiredState()
+	if err != nil {
+		return err
+	}
+	return m.applyState(state, m.backend.Apply)
+}
+
+// applyState runs apply and updates the record of site routes on the
+// interface. The new routes are recorded before apply too, so that routes
+// added by an apply that fails halfway are still known to later syncs.
+func (m *Manager) applyState(state State, apply func(State) error) error {
+	desired := siteRoutes(state.Peers)
+	pending := append(slices.Clone(state.AppliedRoutes), desired...)
+	if err := m.store.SetAppliedRoutes(pending); err != nil {
+		return fmt.Errorf("record site routes: %w", err)
+	}
+	if err := apply(state); err != nil {
+		return err
+	}
+	if err := m.store.SetAppliedRoutes(desired); err != nil {
+		return fmt.Errorf("record site routes: %w", err)
+	}
+	return nil
+}
+
+// autoSync applies the stored peers when auto_sync is on. The change is
+// already stored, so a failed apply is reported rather than returned as an
+// error; the next sync picks it up.
+func (m *Manager) autoSync() *SyncResult {
+	if !m.cfg.AutoSync {
+		return nil
+	}
+	err := m.sync()
+	m.recordSync("auto-sync", err)
+	if err != nil {
+		return &SyncResult{Error: err.Error()}
+	}
+	return &SyncResult{Applied: true}
+}
+
+// recordSync counts the outcome for /metrics. Failing to record must not
+// mask the outcome itself, so it is only logged.
+func (m *Manager) recordSync(operation string, syncErr error) {
+	if err := m.store.RecordSync(operation, syncErr); err != nil {
+		log.Printf("record %s result: %v", operation, err)
+	}
+}
+
+func (m *Manager) SyncStats() ([]SyncStat, error) {
+	return m.store.SyncStats()
+}
+
+// PoolUsage returns how many addresses the pool has and how many are
+// allocated to peers.
+func (m *Manager) PoolUsage() (capacity, allocated int64, err error) {
+	capacity, err = poolCapacity(m.cfg.Address, m.cfg.Address6)
+	if err != nil {
+		return 0, 0, err
+	}
+	allocated, err = m.store.CountPeers()
+	if err != nil {
+		return 0, 0, err
+	}
+	return capacity, allocated, nil
+}
+
+func (m *Manager) Status() ([]PeerStatus, error) {
+	return m.backend.Status()
+}
+
+// PeerStatuses returns the live state of the interface's peers keyed by
+// public key, for merging with stored peers.
+func (m *Manager) PeerStatuses() (map[string]PeerStatus, error) {
+	statuses, err := m.backend.Status()
+	if err != nil {
+		return nil, err
+	}
+	byKey := make(map[string]PeerStatus, len(statuses))
+	for _, st := range statuses {
+		byKey[st.PublicKey] = st
+	}
+	return byKey, nil
+}
+
 func (m *Manager) ServerConfig() (string, error) {
-	peers, err := m.store.EnabledPeers()
+	state, err := m.desiredState()
 	if err != nil {
 		return "", err
 	}
-	return generateServerConfig(m.cfg, peers), nil
+	return generateServerConfig(m.cfg, state), nil
 }
 
-func (m *Manager) ClientConfig(peer *Peer) string {
-	return generateClientConfig(m.cfg, peer)
+// ClientConfig renders the peer's config. For a mesh peer it also records
+// the mesh generation the config reflects, which clears the peer from
+// StaleMeshPeers.
+func (m *Manager) ClientConfig(peer *Peer) (string, error) {
+	var others []Peer
+	var gen int64
+	if peer.IsSite() || peer.IsMesh() {
+		var err error
+		// Read the generation first, so a change that lands while the
+		// config is rendered leaves the peer stale.
+		if gen, err = m.store.MeshGeneration(); err != nil {
+			return "", err
+		}
+		if others, err = m.store.EnabledPeers(); err != nil {
+			return "", err
+		}
+	}
+	config := generateClientConfig(m.cfg, peer, others)
+	if peer.IsMesh() {
+		if err := m.store.MarkMeshConfigSent(peer.Name, gen); err != nil {
+			return "", err
+		}
+	}
+	return config, nil
 }
 
 func (m *Manager) Close() error {
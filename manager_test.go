@@ -0,0 +1,122 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func newTestManager(t *testing.T, cfg *Config) (*Manager, *memoryBackend) {
+	t.Helper()
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := newMemoryBackend()
+	mgr := NewManager(cfg, store, backend)
+	t.Cleanup(func() { mgr.Close() })
+	return mgr, backend
+}
+
+func TestManagerMemoryBackend(t *testing.T) {
+	mgr, backend := newTestManager(t, &Config{Interface: "wg0", Address: "10.0.0.1/24"})
+	if err := mgr.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	alice, _, err := mgr.AddPeer("alice", PeerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, _, err := mgr.AddPeer("bob", PeerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mgr.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	assertApplied(t, backend, map[string]string{
+		alice.PublicKey: "10.0.0.2/32",
+		bob.PublicKey:   "10.0.0.3/32",
+	})
+
+	if _, err := mgr.RemovePeer("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mgr.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	assertApplied(t, backend, map[string]string{bob.PublicKey: "10.0.0.3/32"})
+	if got := backend.Applies(); got != 3 {
+		t.Errorf("applies = %d, want 3 (up and two syncs)", got)
+	}
+}
+
+// assertApplied checks that the backend runs exactly the given peers,
+// keyed by public key, with their tunnel addresses.
+func assertApplied(t *testing.T, backend *memoryBackend, want map[string]string) {
+	t.Helper()
+	statuses, err := backend.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != len(want) {
+		t.Fatalf("applied %d peers, want %d", len(statuses), len(want))
+	}
+	for _, st := range statuses {
+		ip, ok := want[st.PublicKey]
+		if !ok {
+			t.Errorf("unexpected peer %s", st.PublicKey)
+			continue
+		}
+		if !slices.Equal(st.AllowedIPs, []string{ip}) {
+			t.Errorf("peer %s: AllowedIPs = %v, want [%s]", st.PublicKey, st.AllowedIPs, ip)
+		}
+	}
+}
+
+func TestManagerAutoSync(t *testing.T) {
+	mgr, backend := newTestManager(t, &Config{Interface: "wg0", Address: "10.0.0.1/24", AutoSync: true})
+	if err := mgr.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	peer, result, err := mgr.AddPeer("alice", PeerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result == nil || !result.Applied {
+		t.Fatalf("add: sync result = %+v, want applied", result)
+	}
+	assertApplied(t, backend, map[string]string{peer.PublicKey: "10.0.0.2/32"})
+
+	if result, err = mgr.DisablePeer("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if result == nil || !result.Applied {
+		t.Fatalf("disable: sync result = %+v, want applied", result)
+	}
+	assertApplied(t, backend, map[string]string{})
+
+	if result, err = mgr.EnablePeer("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if result == nil || !result.Applied {
+		t.Fatalf("enable: sync result = %+v, want applied", result)
+	}
+	assertApplied(t, backend, map[string]string{peer.PublicKey: "10.0.0.2/32"})
+
+	rotated, result, err := mgr.RotatePresharedKey("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result == nil || !result.Applied {
+		t.Fatalf("rotate: sync result = %+v, want applied", result)
+	}
+	plan, err := mgr.PlanSync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !plan.Empty() || rotated.PresharedKey == "" {
+		t.Errorf("after rotate: plan = %+v, preshared key %q; want the new key applied", plan, rotated.PresharedKey)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Mesh mode: peers added with --endpoint are reachable directly, so their
+// configs list every other enabled mesh peer next to the hub. WireGuard
+// picks the most specific AllowedIPs, so traffic between mesh peers goes
+// direct while everything else still goes through the hub.
+//
+// Mesh configs are never stored, so the other mesh peers only learn about a
+// change when they fetch their config again. The mesh generation counts
+// changes to the set of enabled mesh peers and each peer records the
+// generation of its last config; peers behind the current generation are
+// reported as stale.
+
+// validateEndpoint checks a host:port peer endpoint.
+func validateEndpoint(endpoint string) error {
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil || host == "" {
+		return fmt.Errorf("%w: %q", errInvalidEndpoint, endpoint)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("%w: %q has no valid port", errInvalidEndpoint, endpoint)
+	}
+	return nil
+}
+
+// writeMeshPeers adds a [Peer] block for every enabled mesh peer other than
+// peer itself.
+func writeMeshPeers(sb *strings.Builder, peer *Peer, others []Peer) {
+	for _, other := range others {
+		if other.ID == peer.ID || !other.IsMesh() {
+			continue
+		}
+		sb.WriteString(fmt.Sprintf("\n# %s\n", other.Name))
+		sb.WriteString("[Peer]\n")
+		sb.WriteString(fmt.Sprintf("PublicKey = %s\n", other.PublicKey))
+		sb.WriteString(fmt.Sprintf("Endpoint = %s\n", other.Endpoint))
+		sb.WriteString(fmt.Sprintf("AllowedIPs = %s\n", strings.Join(other.ServerAllowedIPs(), ", ")))
+		sb.WriteString("PersistentKeepalive = 25\n")
+	}
+}
+
+// bumpMeshGenerationTx marks every mesh config as out of date.
+func bumpMeshGenerationTx(tx *sql.Tx) error {
+	_, err := tx.Exec("UPDATE mesh SET generation = generation + 1")
+	return err
+}
+
+// bumpMeshIfMemberTx bumps the mesh generation if name is an enabled mesh
+// peer.
+func bumpMeshIfMemberTx(tx *sql.Tx, name string) error {
+	_, err := tx.Exec(`UPDATE mesh SET generation = generation + 1
+		WHERE EXISTS (SELECT 1 FROM peers WHERE name = ? AND endpoint IS NOT NULL AND enabled = 1)`, name)
+	return err
+}
+
+// MeshGeneration returns the current mesh generation.
+func (s *Store) MeshGeneration() (int64, error) {
+	var gen int64
+	err := s.db.QueryRow("SELECT generation FROM mesh").Scan(&gen)
+	return gen, err
+}
+
+// MarkMeshConfigSent records that the peer got a config of generation gen.
+func (s *Store) MarkMeshConfigSent(name string, gen int64) error {
+	_, err := s.db.Exec("UPDATE peers SET mesh_generation = ? WHERE name = ?", gen, name)
+	return err
+}
+
+// StaleMeshPeers returns the names of the enabled mesh peers whose last
+// config predates the current mesh generation.
+func (s *Store) StaleMeshPeers() ([]string, error) {
+	rows, err := s.db.Query(`SELECT name FROM peers
+		WHERE endpoint IS NOT NULL AND enabled = 1
+		AND (mesh_generation IS NULL OR mesh_generation < (SELECT generation FROM mesh))
+		ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// StaleMeshPeers returns the mesh peers that need their config again.
+func (m *Manager) StaleMeshPeers() ([]string, error) {
+	return m.store.StaleMeshPeers()
+}
+
+// MeshConfig returns the config of a mesh peer. It is rendered on demand
+// and never written to disk, since it holds the peer's private key.
+func (m *Manager) MeshConfig(name string) (string, error) {
+	peer, err := m.store.GetPeer(name)
+	if err != nil {
+		return "", err
+	}
+	if !peer.IsMesh() {
+		return "", errNotMeshPeer
+	}
+	return m.ClientConfig(peer)
+}
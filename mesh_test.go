@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestStaleMeshPeers(t *testing.T) {
+	mgr, _ := newTestManager(t, &Config{Interface: "wg0", Address: "10.0.0.1/24", Endpoint: "vpn.example.com:51820"})
+
+	stale := func(want ...string) {
+		t.Helper()
+		got, err := mgr.StaleMeshPeers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("stale = %v, want %v", got, want)
+		}
+	}
+	export := func(names ...string) {
+		t.Helper()
+		for _, name := range names {
+			if _, err := mgr.MeshConfig(name); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for _, p := range []struct{ name, endpoint string }{
+		{"a", "a.example.com:51820"},
+		{"b", "b.example.com:51820"},
+		{"laptop", ""},
+	} {
+		if _, _, err := mgr.AddPeer(p.name, PeerOptions{Endpoint: p.endpoint}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stale("a", "b")
+	export("a", "b")
+	stale()
+
+	// Peers outside the mesh do not change mesh configs.
+	if _, err := mgr.DisablePeer("laptop"); err != nil {
+		t.Fatal(err)
+	}
+	stale()
+
+	if _, _, err := mgr.AddPeer("c", PeerOptions{Endpoint: "c.example.com:51820"}); err != nil {
+		t.Fatal(err)
+	}
+	stale("a", "b", "c")
+	export("a", "b", "c")
+
+	// A disabled peer is not reported, and disabling it again is no change.
+	if _, err := mgr.DisablePeer("c"); err != nil {
+		t.Fatal(err)
+	}
+	stale("a", "b")
+	export("a", "b")
+	if _, err := mgr.DisablePeer("c"); err != nil {
+		t.Fatal(err)
+	}
+	stale()
+
+	// Removing a disabled mesh peer leaves the other configs current.
+	if _, err := mgr.RemovePeer("c"); err != nil {
+		t.Fatal(err)
+	}
+	stale()
+
+	if _, err := mgr.RemovePeer("b"); err != nil {
+		t.Fatal(err)
+	}
+	stale("a")
+}
+
+func TestWriteMeshPeers(t *testing.T) {
+	self := Peer{ID: "1", Name: "a", PublicKey: "keyA", AllowedIP: "10.0.0.2/32", Endpoint: "a.example.com:51820"}
+	b := Peer{ID: "2", Name: "b", PublicKey: "keyB", AllowedIP: "10.0.0.3/32", Endpoint: "b.example.com:51000"}
+	site := Peer{ID: "3", Name: "branch", PublicKey: "keyC", AllowedIP: "10.0.0.4/32", AllowedIP6: "fd00::4/128",
+		SiteRoutes: []string{"192.168.50.0/24"}, Endpoint: "branch.example.com:51820"}
+	laptop := Peer{ID: "4", Name: "laptop", PublicKey: "keyD", AllowedIP: "10.0.0.5/32"}
+
+	tests := []struct {
+		name   string
+		others []Peer
+		want   string
+	}{
+		{"no others", nil, ""},
+		{"self only", []Peer{self}, ""},
+		{"not in mesh", []Peer{self, laptop}, ""},
+		{"mesh peer", []Peer{self, b, laptop}, `
+# b
+[Peer]
+PublicKey = keyB
+Endpoint = b.example.com:51000
+AllowedIPs = 10.0.0.3/32
+PersistentKeepalive = 25
+`},
+		{"site routes and IPv6", []Peer{site}, `
+# branch
+[Peer]
+PublicKey = keyC
+Endpoint = branch.example.com:51820
+AllowedIPs = 10.0.0.4/32, fd00::4/128, 192.168.50.0/24
+PersistentKeepalive = 25
+`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sb strings.Builder
+			writeMeshPeers(&sb, &self, tt.others)
+			if got := sb.String(); got != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMeshClientConfig(t *testing.T) {
+	mgr, _ := newTestManager(t, &Config{Interface: "wg0", Address: "10.0.0.1/24", Endpoint: "vpn.example.com:51820"})
+
+	peers := map[string]*Peer{}
+	for _, p := range []struct {
+		name string
+		opts PeerOptions
+	}{
+		{"a", PeerOptions{Endpoint: "a.example.com:51820"}},
+		{"b", PeerOptions{Endpoint: "b.example.com:51000", SiteRoutes: []string{"192.168.50.0/24"}}},
+		{"off", PeerOptions{Endpoint: "off.example.com:51820"}},
+		{"laptop", PeerOptions{}},
+	} {
+		peer, _, err := mgr.AddPeer(p.name, p.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		peers[p.name] = peer
+	}
+	if _, err := mgr.DisablePeer("off"); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := mgr.MeshConfig("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		line string
+		want bool
+	}{
+		{"listen port", "ListenPort = 51820\n", true},
+		{"mesh peer", "# b\n[Peer]\nPublicKey = " + peers["b"].PublicKey + "\nEndpoint = b.example.com:51000\n", true},
+		{"server allowed IPs", "AllowedIPs = 10.0.0.3/32, 192.168.50.0/24\n", true},
+		{"itself", "Endpoint = a.example.com:51820", false},
+		{"disabled peer", peers["off"].PublicKey, false},
+		{"peer outside the mesh", peers["laptop"].PublicKey, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := strings.Contains(config, tt.line); got != tt.want {
+				t.Errorf("config contains %q = %v, want %v\n%s", tt.line, got, tt.want, config)
+			}
+		})
+	}
+
+	if _, err := mgr.MeshConfig("laptop"); !errors.Is(err, errNotMeshPeer) {
+		t.Errorf("MeshConfig(laptop) error = %v, want %v", err, errNotMeshPeer)
+	}
+}
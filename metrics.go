@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prometheus text exposition for `vpn web`. The format is simple enough that
+// it is written by hand rather than pulling in the client library.
+
+// latencyBuckets are the upper bounds, in seconds, of the API latency
+// histogram.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+type routeKey struct {
+	Route  string
+	Method string
+	Status int
+}
+
+type routeStats struct {
+	count   int64
+	sum     float64
+	buckets []int64
+}
+
+// apiMetrics counts API requests and their latencies by route and status.
+type apiMetrics struct {
+	mu     sync.Mutex
+	routes map[routeKey]*routeStats
+}
+
+func newAPIMetrics() *apiMetrics {
+	return &apiMetrics{routes: make(map[routeKey]*routeStats)}
+}
+
+func (m *apiMetrics) observe(key routeKey, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	st, ok := m.routes[key]
+	if !ok {
+		st = &routeStats{buckets: make([]int64, len(latencyBuckets))}
+		m.routes[key] = st
+	}
+	secs := d.Seconds()
+	st.count++
+	st.sum += secs
+	for i, le := range latencyBuckets {
+		if secs <= le {
+			st.buckets[i]++
+		}
+	}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Instrument wraps the API mux and records every request under the mux
+// pattern it matched, which keeps the route label bounded.
+func (a *APIServer) Instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		route := r.Pattern
+		if i := strings.IndexByte(route, ' '); i >= 0 {
+			route = route[i+1:]
+		}
+		if route == "" {
+			route = "unmatched"
+		}
+		a.metrics.observe(routeKey{Route: route, Method: methodLabel(r.Method), Status: rec.status}, time.Since(start))
+	})
+}
+
+// methodLabel keeps the method label bounded: clients can send any token
+// as the method, so anything but the standard methods counts as "other".
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	default:
+		return "other"
+	}
+}
+
+// HandleMetrics serves GET /metrics.
+func (a *APIServer) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	a.writePeerMetrics(w)
+	a.writePoolMetrics(w)
+	a.writeSyncMetrics(w)
+	a.metrics.write(w)
+}
+
+func (a *APIServer) writePeerMetrics(w io.Writer) {
+	peers, err := a.mgr.ListPeers()
+	if err != nil {
+		return
+	}
+	enabled := 0
+	for _, p := range peers {
+		if p.Enabled {
+			enabled++
+		}
+	}
+	writeHeader(w, "vpn_peers", "gauge", "Number of peers in the database.")
+	fmt.Fprintf(w, "vpn_peers %d\n", len(peers))
+	writeHeader(w, "vpn_peers_enabled", "gauge", "Number of enabled peers.")
+	fmt.Fprintf(w, "vpn_peers_enabled %d\n", enabled)
+
+	statuses, err := a.mgr.PeerStatuses()
+	writeHeader(w, "vpn_interface_status_up", "gauge", "Whether live peer status could be read from the interface.")
+	if err != nil {
+		fmt.Fprintln(w, "vpn_interface_status_up 0")
+		return
+	}
+	fmt.Fprintln(w, "vpn_interface_status_up 1")
+
+	now := time.Now()
+	writeHeader(w, "vpn_peer_handshake_age_seconds", "gauge", "Seconds since the peer's latest handshake.")
+	for _, p := range peers {
+		if st, ok := statuses[p.PublicKey]; ok && !st.LastHandshake.IsZero() {
+			fmt.Fprintf(w, "vpn_peer_handshake_age_seconds{peer=%s} %s\n",
+				quoteLabel(p.Name), formatFloat(now.Sub(st.LastHandshake).Seconds()))
+		}
+	}
+	writeHeader(w, "vpn_peer_receive_bytes_total", "counter", "Bytes received from the peer since the interface came up.")
+	for _, p := range peers {
+		if st, ok := statuses[p.PublicKey]; ok {
+			fmt.Fprintf(w, "vpn_peer_receive_bytes_total{peer=%s} %d\n", quoteLabel(p.Name), st.RxBytes)
+		}
+	}
+	writeHeader(w, "vpn_peer_transmit_bytes_total", "counter", "Bytes sent to the peer since the interface came up.")
+	for _, p := range peers {
+		if st, ok := statuses[p.PublicKey]; ok {
+			fmt.Fprintf(w, "vpn_peer_transmit_bytes_total{peer=%s} %d\n", quoteLabel(p.Name), st.TxBytes)
+		}
+	}
+}
+
+func (a *APIServer) writePoolMetrics(w io.Writer) {
+	capacity, allocated, err := a.mgr.PoolUsage()
+	if err != nil {
+		return
+	}
+	writeHeader(w, "vpn_pool_addresses", "gauge", "Peer addresses available in the pool.")
+	fmt.Fprintf(w, "vpn_pool_addresses %d\n", capacity)
+	writeHeader(w, "vpn_pool_addresses_allocated", "gauge", "Peer addresses allocated from the pool.")
+	fmt.Fprintf(w, "vpn_pool_addresses_allocated %d\n", allocated)
+	if capacity > 0 {
+		writeHeader(w, "vpn_pool_utilization_ratio", "gauge", "Fraction of the pool that is allocated.")
+		fmt.Fprintf(w, "vpn_pool_utilization_ratio %s\n", formatFloat(float64(allocated)/float64(capacity)))
+	}
+}
+
+func (a *APIServer) writeSyncMetrics(w io.Writer) {
+	stats, err := a.mgr.SyncStats()
+	if err != nil {
+		return
+	}
+	writeHeader(w, "vpn_sync_total", "counter", "Interface up/sync attempts by result.")
+	for _, st := range stats {
+		fmt.Fprintf(w, "vpn_sync_total{operation=%s,result=%s} %d\n", quoteLabel(st.Operation), quoteLabel(st.Result), st.Count)
+	}
+	writeHeader(w, "vpn_sync_last_timestamp_seconds", "gauge", "Unix time of the latest up/sync attempt by result.")
+	for _, st := range stats {
+		fmt.Fprintf(w, "vpn_sync_last_timestamp_seconds{operation=%s,result=%s} %d\n", quoteLabel(st.Operation), quoteLabel(st.Result), st.LastAt.Unix())
+	}
+}
+
+func (m *apiMetrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]routeKey, 0, len(m.routes))
+	for k := range m.routes {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Route != keys[j].Route {
+			return keys[i].Route < keys[j].Route
+		}
+		if keys[i].Method != keys[j].Method {
+			return keys[i].Method < keys[j].Method
+		}
+		return keys[i].Status < keys[j].Status
+	})
+
+	writeHeader(w, "vpn_api_requests_total", "counter", "API requests by route, method and status.")
+	for _, k := range keys {
+		fmt.Fprintf(w, "vpn_api_requests_total{%s} %d\n", k.labels(), m.routes[k].count)
+	}
+	writeHeader(w, "vpn_api_request_duration_seconds", "histogram", "API request latency by route, method and status.")
+	for _, k := range keys {
+		st := m.routes[k]
+		for i, le := range latencyBuckets {
+			fmt.Fprintf(w, "vpn_api_request_duration_seconds_bucket{%s,le=%q} %d\n", k.labels(), formatFloat(le), st.buckets[i])
+		}
+		fmt.Fprintf(w, "vpn_api_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", k.labels(), st.count)
+		fmt.Fprintf(w, "vpn_api_request_duration_seconds_sum{%s} %s\n", k.labels(), formatFloat(st.sum))
+		fmt.Fprintf(w, "vpn_api_request_duration_seconds_count{%s} %d\n", k.labels(), st.count)
+	}
+}
+
+func (k routeKey) labels() string {
+	return fmt.Sprintf("route=%s,method=%s,status=\"%d\"", quoteLabel(k.Route), quoteLabel(k.Method), k.Status)
+}
+
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
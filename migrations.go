@@ -0,0 +1,383 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Schema changes are numbered migrations applied in order, each in its own
+// transaction, and recorded in schema_migrations. Append new migrations to
+// the end of the list; never edit or reorder ones that have shipped.
+//
+// Databases created before schema_migrations existed may already contain
+// some of these changes, so the early migrations check before altering.
+
+var errSchemaTooNew = errors.New("database schema is newer than this binary")
+
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+}
+
+var migrations = []migration{
+	{1, "create peers", func(tx *sql.Tx) error {
+		return execAll(tx, `CREATE TABLE IF NOT EXISTS peers (
+			id TEXT PRIMARY KEY,
+			name TEXT UNIQUE NOT NULL,
+			public_key TEXT UNIQUE NOT NULL,
+			allowed_ip TEXT UNIQUE NOT NULL,
+			enabled INTEGER DEFAULT 1,
+			created_at DATETIME NOT NULL
+		)`)
+	}},
+	{2, "add peer private keys", func(tx *sql.Tx) error {
+		return addColumn(tx, "peers", "private_key", "TEXT")
+	}},
+	{3, "add peer IPv6 addresses", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "peers", "allowed_ip6", "TEXT"); err != nil {
+			return err
+		}
+		// SQLite cannot add a UNIQUE column, so enforce it with an index instead.
+		return execAll(tx, "CREATE UNIQUE INDEX IF NOT EXISTS peers_allowed_ip6 ON peers (allowed_ip6)")
+	}},
+	{4, "add peer pool offsets", func(tx *sql.Tx) error {
+		// ip_offset is the peer's host number within the address pool. Rows
+		// that predate it are backfilled lazily by allocateIPTx.
+		if err := addColumn(tx, "peers", "ip_offset", "INTEGER"); err != nil {
+			return err
+		}
+		return execAll(tx, "CREATE UNIQUE INDEX IF NOT EXISTS peers_ip_offset ON peers (ip_offset)")
+	}},
+	{5, "add usage history", func(tx *sql.Tx) error {
+		// peer_counters holds the last raw WireGuard counters seen per peer
+		// and peer_usage the per-sample deltas derived from them (unix
+		// timestamps).
+		return execAll(tx,
+			`CREATE TABLE IF NOT EXISTS peer_counters (
+				peer_id TEXT PRIMARY KEY,
+				rx_bytes INTEGER NOT NULL,
+				tx_bytes INTEGER NOT NULL,
+				sampled_at INTEGER NOT NULL
+			)`,
+			`CREATE TABLE IF NOT EXISTS peer_usage (
+				peer_id TEXT NOT NULL,
+				sampled_at INTEGER NOT NULL,
+				rx_bytes INTEGER NOT NULL,
+				tx_bytes INTEGER NOT NULL
+			)`,
+			"CREATE INDEX IF NOT EXISTS peer_usage_peer_time ON peer_usage (peer_id, sampled_at)",
+		)
+	}},
+	{6, "add preshared keys", func(tx *sql.Tx) error {
+		return addColumn(tx, "peers", "preshared_key", "TEXT")
+	}},
+	{7, "add sync events", func(tx *sql.Tx) error {
+		// sync_events counts up/sync outcomes so /metrics can report
+		// failures of CLI runs too, not just those of the web process.
+		return execAll(tx, `CREATE TABLE IF NOT EXISTS sync_events (
+			operation TEXT NOT NULL,
+			result TEXT NOT NULL,
+			count INTEGER NOT NULL,
+			last_at INTEGER NOT NULL,
+			PRIMARY KEY (operation, result)
+		)`)
+	}},
+	{8, "add peer client routes", func(tx *sql.Tx) error {
+		// routes is a comma-separated prefix list; NULL uses the server
+		// default.
+		return execAll(tx, "ALTER TABLE peers ADD COLUMN routes TEXT")
+	}},
+	{9, "add site routes", func(tx *sql.Tx) error {
+		return execAll(tx, "ALTER TABLE peers ADD COLUMN site_routes TEXT")
+	}},
+	{10, "add peer mesh endpoints", func(tx *sql.Tx) error {
+		return execAll(tx, "ALTER TABLE peers ADD COLUMN endpoint TEXT")
+	}},
+	{11, "add groups and policies", func(tx *sql.Tx) error {
+		return execAll(tx,
+			`CREATE TABLE groups (
+				name TEXT PRIMARY KEY,
+				created_at INTEGER NOT NULL
+			)`,
+			`CREATE TABLE peer_groups (
+				peer_id TEXT NOT NULL,
+				group_name TEXT NOT NULL,
+				PRIMARY KEY (peer_id, group_name)
+			)`,
+			`CREATE TABLE policies (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				group_name TEXT NOT NULL,
+				destination TEXT NOT NULL,
+				protocol TEXT NOT NULL,
+				port TEXT NOT NULL,
+				created_at INTEGER NOT NULL
+			)`,
+		)
+	}},
+	{12, "add api tokens", func(tx *sql.Tx) error {
+		return execAll(tx,
+			`CREATE TABLE api_tokens (
+				name TEXT PRIMARY KEY,
+				token_hash TEXT NOT NULL UNIQUE,
+				scopes TEXT NOT NULL,
+				created_at INTEGER NOT NULL,
+				last_used_at INTEGER
+			)`,
+		)
+	}},
+	{13, "add users and group ownership", func(tx *sql.Tx) error {
+		return execAll(tx,
+			`CREATE TABLE users (
+				name TEXT PRIMARY KEY,
+				role TEXT NOT NULL,
+				created_at INTEGER NOT NULL
+			)`,
+			`CREATE TABLE user_groups (
+				user_name TEXT NOT NULL,
+				group_name TEXT NOT NULL,
+				PRIMARY KEY (user_name, group_name)
+			)`,
+			"ALTER TABLE api_tokens ADD COLUMN user_name TEXT",
+		)
+	}},
+	{14, "record applied site routes", func(tx *sql.Tx) error {
+		// applied_routes lists the site prefixes routed to the interface, so
+		// that sync removes only routes it added. It starts out with the
+		// current sites, which earlier versions routed the same way.
+		if err := execAll(tx, "CREATE TABLE applied_routes (prefix TEXT PRIMARY KEY)"); err != nil {
+			return err
+		}
+		rows, err := tx.Query("SELECT site_routes FROM peers WHERE site_routes IS NOT NULL")
+		if err != nil {
+			return err
+		}
+		var prefixes []string
+		for rows.Next() {
+			var routes string
+			if err := rows.Scan(&routes); err != nil {
+				rows.Close()
+				return err
+			}
+			prefixes = append(prefixes, strings.Split(routes, ",")...)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, p := range prefixes {
+			if _, err := tx.Exec("INSERT OR IGNORE INTO applied_routes (prefix) VALUES (?)", p); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{15, "track mesh generations", func(tx *sql.Tx) error {
+		// mesh.generation counts changes to the set of enabled mesh peers;
+		// peers.mesh_generation is the generation of the peer's last
+		// handed-out config. Existing mesh peers start out stale.
+		return execAll(tx,
+			"CREATE TABLE mesh (generation INTEGER NOT NULL)",
+			"INSERT INTO mesh (generation) VALUES (1)",
+			"ALTER TABLE peers ADD COLUMN mesh_generation INTEGER",
+		)
+	}},
+	{16, "record removed peers", func(tx *sql.Tx) error {
+		// removed_peers maps the IDs of removed peers to their names, so
+		// that their usage stays queryable.
+		return execAll(tx, `CREATE TABLE removed_peers (
+			id TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			removed_at INTEGER NOT NULL
+		)`)
+	}},
+}
+
+// schemaVersion is the newest schema this binary understands.
+func schemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// MigrationStatus is one row of `vpn db migrate --status`. AppliedAt is zero
+// for pending migrations; Known is false for versions recorded in the
+// database that this binary does not ship.
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt time.Time
+	Known     bool
+}
+
+func (m MigrationStatus) Applied() bool {
+	return !m.AppliedAt.IsZero()
+}
+
+// Migrate applies all pending migrations and returns the ones it ran. It
+// refuses to touch a database written by a newer binary.
+func (s *Store) Migrate() ([]MigrationStatus, error) {
+	if err := execAll(s.db, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at INTEGER NOT NULL
+	)`); err != nil {
+		return nil, fmt.Errorf("create schema_migrations table: %w", err)
+	}
+
+	current, err := s.currentVersion(s.db)
+	if err != nil {
+		return nil, err
+	}
+	if current > schemaVersion() {
+		return nil, fmt.Errorf("%w: database is at version %d, this binary supports up to %d",
+			errSchemaTooNew, current, schemaVersion())
+	}
+
+	var applied []MigrationStatus
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		at, err := s.apply(m)
+		if err != nil {
+			return applied, fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+		if !at.IsZero() {
+			applied = append(applied, MigrationStatus{Version: m.version, Name: m.name, AppliedAt: at, Known: true})
+		}
+	}
+	return applied, nil
+}
+
+// apply runs one migration and records it. It returns a zero time if
+// another process applied the migration first.
+func (s *Store) apply(m migration) (time.Time, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	current, err := s.currentVersion(tx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if current >= m.version {
+		return time.Time{}, nil
+	}
+	if err := m.up(tx); err != nil {
+		return time.Time{}, err
+	}
+	now := time.Now()
+	if _, err := tx.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)",
+		m.version, m.name, now.Unix()); err != nil {
+		return time.Time{}, err
+	}
+	return now, tx.Commit()
+}
+
+func (s *Store) currentVersion(q queryer) (int, error) {
+	var version sql.NullInt64
+	if err := q.QueryRow("SELECT MAX(version) FROM schema_migrations").Scan(&version); err != nil {
+		return 0, fmt.Errorf("read schema version: %w", err)
+	}
+	return int(version.Int64), nil
+}
+
+// MigrationStatus lists every known migration with when it was applied,
+// followed by any versions recorded in the database that this binary does
+// not know about. It does not apply anything.
+func (s *Store) MigrationStatus() ([]MigrationStatus, error) {
+	// A database from before schema_migrations has nothing recorded.
+	tracked, err := hasTable(s.db, "schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[int]time.Time)
+	var unknown []MigrationStatus
+	if tracked {
+		rows, err := s.db.Query("SELECT version, name, applied_at FROM schema_migrations ORDER BY version")
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var st MigrationStatus
+			var at int64
+			if err := rows.Scan(&st.Version, &st.Name, &at); err != nil {
+				return nil, err
+			}
+			st.AppliedAt = time.Unix(at, 0)
+			applied[st.Version] = st.AppliedAt
+			if st.Version > schemaVersion() {
+				unknown = append(unknown, st)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	out := make([]MigrationStatus, 0, len(migrations)+len(unknown))
+	for _, m := range migrations {
+		st := MigrationStatus{Version: m.version, Name: m.name, Known: true}
+		st.AppliedAt = applied[m.version]
+		out = append(out, st)
+	}
+	return append(out, unknown...), nil
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx.
+type queryer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+func execAll(q queryer, stmts ...string) error {
+	for _, stmt := range stmts {
+		if _, err := q.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addColumn adds a column unless an older binary already did.
+func addColumn(q queryer, table, column, typ string) error {
+	ok, err := hasColumn(q, table, column)
+	if err != nil || ok {
+		return err
+	}
+	_, err = q.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + typ)
+	return err
+}
+
+func hasTable(q queryer, table string) (bool, error) {
+	var n int
+	err := q.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&n)
+	return n > 0, err
+}
+
+func hasColumn(q queryer, table, column string) (bool, error) {
+	rows, err := q.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return false, fmt.Errorf("table info: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid int
+		var colName, colType string
+		var notnull, dfltVal, pk interface{}
+		if err := rows.Scan(&cid, &colName, &colType, &notnull, &dfltVal, &pk); err != nil {
+			return false, fmt.Errorf("scan table info: %w", err)
+		}
+		if colName == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Minimal netlink plumbing for the native backend. Only what the WireGuard
+// and rtnetlink requests in wireguard_netlink_linux.go need is implemented.
+
+const (
+	nlaFNested  = 0x8000
+	nlaTypeMask = ^uint16(nlaFNested | 0x4000)
+
+	genlIDCtrl         = 0x10
+	ctrlCmdGetFamily   = 3
+	ctrlAttrFamilyID   = 1
+	ctrlAttrFamilyName = 2
+	genlHdrLen         = 4
+	nlRecvBufSize      = 1 << 16
+	nlMsgHdrLen        = syscall.SizeofNlMsghdr
+)
+
+// NetlinkError is returned by the native backend when the kernel rejects a
+// request. Err is usually a syscall.Errno, so callers can use errors.Is.
+type NetlinkError struct {
+	Op  string
+	Err error
+}
+
+func (e *NetlinkError) Error() string {
+	return fmt.Sprintf("netlink %s: %v", e.Op, e.Err)
+}
+
+func (e *NetlinkError) Unwrap() error {
+	return e.Err
+}
+
+type nlConn struct {
+	fd  int
+	seq uint32
+}
+
+func dialNetlink(proto int) (*nlConn, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, &NetlinkError{Op: "socket", Err: err}
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		syscall.Close(fd)
+		return nil, &NetlinkError{Op: "bind", Err: err}
+	}
+	return &nlConn{fd: fd}, nil
+}
+
+func (c *nlConn) Close() error {
+	return syscall.Close(c.fd)
+}
+
+// execute sends one request and collects the payloads of the replies. Dump
+// requests end at NLMSG_DONE; everything else is sent with NLM_F_ACK and
+// ends at the kernel's acknowledgement.
+func (c *nlConn) execute(op string, typ, flags uint16, body []byte) ([][]byte, error) {
+	c.seq++
+	dump := flags&syscall.NLM_F_DUMP == syscall.NLM_F_DUMP
+	if !dump {
+		flags |= syscall.NLM_F_ACK
+	}
+
+	msg := make([]byte, nlMsgHdrLen, nlMsgHdrLen+len(body))
+	binary.NativeEndian.PutUint32(msg[0:4], uint32(nlMsgHdrLen+len(body)))
+	binary.NativeEndian.PutUint16(msg[4:6], typ)
+	binary.NativeEndian.PutUint16(msg[6:8], flags|syscall.NLM_F_REQUEST)
+	binary.NativeEndian.PutUint32(msg[8:12], c.seq)
+	msg = append(msg, body...)
+
+	if err := syscall.Sendto(c.fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, &NetlinkError{Op: op, Err: err}
+	}
+
+	var replies [][]byte
+	buf := make([]byte, nlRecvBufSize)
+	for {
+		n, _, err := syscall.Recvfrom(c.fd, buf, 0)
+		if err != nil {
+			return nil, &NetlinkError{Op: op, Err: err}
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, &NetlinkError{Op: op, Err: err}
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != c.seq {
+				continue
+			}
+			switch m.Header.Type {
+			case syscall.NLMSG_ERROR, syscall.NLMSG_DONE:
+				if len(m.Data) >= 4 {
+					if errno := int32(binary.NativeEndian.Uint32(m.Data[0:4])); errno != 0 {
+						return nil, &NetlinkError{Op: op, Err: syscall.Errno(-errno)}
+					}
+				}
+				if m.Header.Type == syscall.NLMSG_DONE || !dump {
+					return replies, nil
+				}
+			default:
+				data := make([]byte, len(m.Data))
+				copy(data, m.Data)
+				replies = append(replies, data)
+			}
+		}
+	}
+}
+
+// nlAttrs builds a netlink attribute stream.
+type nlAttrs struct {
+	b []byte
+}
+
+func (a *nlAttrs) bytes(typ uint16, data []byte) {
+	hdr := make([]byte, 4)
+	binary.NativeEndian.PutUint16(hdr[0:2], uint16(4+len(data)))
+	binary.NativeEndian.PutUint16(hdr[2:4], typ)
+	a.b = append(a.b, hdr...)
+	a.b = append(a.b, data...)
+	a.pad()
+}
+
+func (a *nlAttrs) str(typ uint16, s string) {
+	a.bytes(typ, append([]byte(s), 0))
+}
+
+func (a *nlAttrs) u8(typ uint16, v uint8) {
+	a.bytes(typ, []byte{v})
+}
+
+func (a *nlAttrs) u16(typ uint16, v uint16) {
+	b := make([]byte, 2)
+	binary.NativeEndian.PutUint16(b, v)
+	a.bytes(typ, b)
+}
+
+func (a *nlAttrs) u32(typ uint16, v uint32) {
+	b := make([]byte, 4)
+	binary.NativeEndian.PutUint32(b, v)
+	a.bytes(typ, b)
+}
+
+func (a *nlAttrs) nested(typ uint16, fn func(*nlAttrs)) {
+	start := len(a.b)
+	a.b = append(a.b, 0, 0, 0, 0)
+	fn(a)
+	binary.NativeEndian.PutUint16(a.b[start:start+2], uint16(len(a.b)-start))
+	binary.NativeEndian.PutUint16(a.b[start+2:start+4], typ|nlaFNested)
+}
+
+func (a *nlAttrs) pad() {
+	for len(a.b)%4 != 0 {
+		a.b = append(a.b, 0)
+	}
+}
+
+type nlAttr struct {
+	Type uint16
+	Data []byte
+}
+
+func parseAttrs(b []byte) ([]nlAttr, error) {
+	var attrs []nlAttr
+	for len(b) >= 4 {
+		l := int(binary.NativeEndian.Uint16(b[0:2]))
+		if l < 4 || l > len(b) {
+			return nil, fmt.Errorf("malformed netlink attribute")
+		}
+		attrs = append(attrs, nlAttr{
+			Type: binary.NativeEndian.Uint16(b[2:4]) & nlaTypeMask,
+			Data: b[4:l],
+		})
+		l = (l + 3) &^ 3
+		if l > len(b) {
+			break
+		}
+		b = b[l:]
+	}
+	return attrs, nil
+}
+
+// genlFamily resolves a generic netlink family name to its message type.
+func genlFamily(c *nlConn, name string) (uint16, error) {
+	var attrs nlAttrs
+	attrs.str(ctrlAttrFamilyName, name)
+	body := append([]byte{ctrlCmdGetFamily, 1, 0, 0}, attrs.b...)
+
+	replies, err := c.execute("resolve "+name, genlIDCtrl, syscall.NLM_F_REQUEST, body)
+	if err != nil {
+		return 0, err
+	}
+	for _, reply := range replies {
+		if len(reply) < genlHdrLen {
+			continue
+		}
+		parsed, err := parseAttrs(reply[genlHdrLen:])
+		if err != nil {
+			return 0, err
+		}
+		for _, attr := range parsed {
+			if attr.Type == ctrlAttrFamilyID && len(attr.Data) >= 2 {
+				return binary.NativeEndian.Uint16(attr.Data), nil
+			}
+		}
+	}
+	return 0, &NetlinkError{Op: "resolve " + name, Err: os.ErrNotExist}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// nftTable is the table Tunnel Manager owns for the interface. Nothing else
+// should add rules to it: every sync replaces it whole.
+func nftTable(cfg *Config) string {
+	return "inet vpn-" + cfg.Interface
+}
+
+// compileNFTables renders the firewall as one nft batch. Up and sync both
+// declare, delete and recreate the table in the same transaction, so the
+// kernel switches from the old ruleset to the new one atomically.
+func compileNFTables(cfg *Config, peers []Peer, groups []Group, memberOf map[string][]string, byGroup map[string][]Policy) firewallRules {
+	down := []string{nftTeardown(cfg)}
+	if len(groups) == 0 && cfg.NATInterface == "" {
+		return firewallRules{Sync: down, Down: down}
+	}
+
+	var forward, dispatch []string
+	if len(groups) > 0 {
+		forward = append(forward,
+			`iifname "%i" ct state established,related accept`,
+			`iifname "%i" jump peers`)
+	}
+	if cfg.NATInterface != "" {
+		forward = append(forward, `iifname "%i" accept`)
+	}
+	for _, peer := range peers {
+		names := memberOf[peer.Name]
+		if len(names) == 0 {
+			continue
+		}
+		sort.Strings(names)
+		for _, match := range nftSourceMatches(peer) {
+			for _, name := range names {
+				dispatch = append(dispatch, fmt.Sprintf("%s jump group-%s", match, name))
+			}
+			dispatch = append(dispatch, match+" drop")
+		}
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "add table %s; delete table %s; table %s { ", nftTable(cfg), nftTable(cfg), nftTable(cfg))
+	sb.WriteString(nftChain("forward", "type filter hook forward priority 0; policy accept", forward))
+	if len(groups) > 0 {
+		sb.WriteString(nftChain("peers", "", dispatch))
+		for _, g := range groups {
+			var accept []string
+			for _, p := range byGroup[g.Name] {
+				accept = append(accept, nftPolicyRule(p))
+			}
+			sb.WriteString(nftChain("group-"+g.Name, "", accept))
+		}
+	}
+	if cfg.NATInterface != "" {
+		sb.WriteString(nftChain("postrouting", "type nat hook postrouting priority 100; policy accept",
+			[]string{fmt.Sprintf("oifname %q masquerade", cfg.NATInterface)}))
+	}
+	sb.WriteString("}")
+
+	apply := fmt.Sprintf("nft '%s'", sb.String())
+	return firewallRules{Up: []string{apply}, Sync: []string{apply}, Down: down}
+}
+
+// nftTeardown deletes the table if it exists.
+func nftTeardown(cfg *Config) string {
+	return fmt.Sprintf("if nft list table %s >/dev/null 2>&1; then nft delete table %s; fi", nftTable(cfg), nftTable(cfg))
+}
+
+// nftChain renders a chain on one line; hook is empty for regular chains.
+func nftChain(name, hook string, rules []string) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "chain %s { ", name)
+	if hook != "" {
+		sb.WriteString(hook + "; ")
+	}
+	for _, rule := range rules {
+		sb.WriteString(rule + "; ")
+	}
+	sb.WriteString("} ")
+	return sb.String()
+}
+
+func nftSourceMatches(peer Peer) []string {
+	var matches []string
+	if peer.AllowedIP != "" {
+		matches = append(matches, "ip saddr "+peer.AllowedIP)
+	}
+	if peer.AllowedIP6 != "" {
+		matches = append(matches, "ip6 saddr "+peer.AllowedIP6)
+	}
+	return matches
+}
+
+// nftPolicyRule renders one policy as an accept rule. The inet family
+// handles both address families, so unlike iptables a policy is one rule.
+func nftPolicyRule(p Policy) string {
+	var parts []string
+	if p.Destination != "any" {
+		if prefix, err := netip.ParsePrefix(p.Destination); err == nil && prefix.Addr().Is6() {
+			parts = append(parts, "ip6 daddr "+p.Destination)
+		} else {
+			parts = append(parts, "ip daddr "+p.Destination)
+		}
+	}
+	switch {
+	case p.Port != "":
+		parts = append(parts, p.Protocol+" dport "+p.Port)
+	case p.Protocol != protoAny:
+		parts = append(parts, "meta l4proto "+p.Protocol)
+	}
+	return strings.Join(append(parts, "accept"), " ")
+}
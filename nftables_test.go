@@ -0,0 +1,81 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestCompileNFTables(t *testing.T) {
+	peers := []Peer{
+		{Name: "alice", AllowedIP: "10.0.0.2/32", AllowedIP6: "fd00::2/128"},
+		{Name: "bob", AllowedIP: "10.0.0.3/32"},
+	}
+	teardown := []string{"if nft list table inet vpn-wg0 >/dev/null 2>&1; then nft delete table inet vpn-wg0; fi"}
+
+	tests := []struct {
+		name     string
+		cfg      Config
+		groups   []Group
+		policies []Policy
+		wantUp   []string
+		wantSync []string
+	}{
+		{
+			name:     "nothing to install",
+			cfg:      Config{Interface: "wg0"},
+			wantSync: teardown,
+		},
+		{
+			name: "NAT only",
+			cfg:  Config{Interface: "wg0", NATInterface: "eth0"},
+			wantUp: []string{`nft 'add table inet vpn-wg0; delete table inet vpn-wg0; table inet vpn-wg0 { ` +
+				`chain forward { type filter hook forward priority 0; policy accept; iifname "%i" accept; } ` +
+				`chain postrouting { type nat hook postrouting priority 100; policy accept; oifname "eth0" masquerade; } }'`},
+		},
+		{
+			name: "groups and NAT",
+			cfg:  Config{Interface: "wg0", NATInterface: "eth0"},
+			groups: []Group{
+				{Name: "dev", Members: []string{"alice"}},
+				{Name: "ops"},
+			},
+			policies: []Policy{
+				{Group: "dev", Destination: "10.20.0.0/16", Protocol: protoTCP, Port: "8000-8100"},
+				{Group: "dev", Destination: "fd00:20::/48", Protocol: protoUDP},
+				{Group: "ops", Destination: "any"},
+			},
+			wantUp: []string{`nft 'add table inet vpn-wg0; delete table inet vpn-wg0; table inet vpn-wg0 { ` +
+				`chain forward { type filter hook forward priority 0; policy accept; ` +
+				`iifname "%i" ct state established,related accept; iifname "%i" jump peers; iifname "%i" accept; } ` +
+				`chain peers { ip saddr 10.0.0.2/32 jump group-dev; ip saddr 10.0.0.2/32 drop; ` +
+				`ip6 saddr fd00::2/128 jump group-dev; ip6 saddr fd00::2/128 drop; } ` +
+				`chain group-dev { ip daddr 10.20.0.0/16 tcp dport 8000-8100 accept; ip6 daddr fd00:20::/48 meta l4proto udp accept; } ` +
+				`chain group-ops { accept; } ` +
+				`chain postrouting { type nat hook postrouting priority 100; policy accept; oifname "eth0" masquerade; } }'`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.Firewall = firewallNFTables
+			rules, err := compileFirewall(&cfg, peers, tt.groups, tt.policies)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantSync := tt.wantSync
+			if wantSync == nil {
+				// Sync replaces the table the same way up creates it.
+				wantSync = tt.wantUp
+			}
+			if !slices.Equal(rules.Up, tt.wantUp) {
+				t.Errorf("Up:\n got %q\nwant %q", rules.Up, tt.wantUp)
+			}
+			if !slices.Equal(rules.Sync, wantSync) {
+				t.Errorf("Sync:\n got %q\nwant %q", rules.Sync, wantSync)
+			}
+			if !slices.Equal(rules.Down, teardown) {
+				t.Errorf("Down:\n got %q\nwant %q", rules.Down, teardown)
+			}
+		})
+	}
+}
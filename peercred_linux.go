@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// peerCredentials returns who is on the other end of a Unix socket
+// connection, using SO_PEERCRED.
+func peerCredentials(conn net.Conn) (*peerCred, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, fmt.Errorf("not a unix socket connection")
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var ucred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return nil, err
+	}
+	if credErr != nil {
+		return nil, fmt.Errorf("SO_PEERCRED: %w", credErr)
+	}
+	return &peerCred{UID: ucred.Uid, GID: ucred.Gid, PID: ucred.Pid}, nil
+}
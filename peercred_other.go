@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"runtime"
+)
+
+func peerCredentials(conn net.Conn) (*peerCred, error) {
+	return nil, errors.New("peer credentials are not supported on " + runtime.GOOS)
+}
@@ -2,20 +2,96 @@ package main
 
 import (
 	"errors"
+	"net"
+	"regexp"
+	"strings"
 	"time"
 )
 
 type Peer struct {
-	ID         string    `json:"id"`
-	Name       string    `json:"name"`
-	PublicKey  string    `json:"public_key"`
-	PrivateKey string    `json:"private_key,omitempty"`
-	AllowedIP  string    `json:"allowed_ip"`
-	Enabled    bool      `json:"enabled"`
-	CreatedAt  time.Time `json:"created_at"`
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	PublicKey    string    `json:"public_key"`
+	PrivateKey   string    `json:"private_key,omitempty"`
+	PresharedKey string    `json:"preshared_key,omitempty"`
+	AllowedIP    string    `json:"allowed_ip"`
+	AllowedIP6   string    `json:"allowed_ip6,omitempty"`
+	Routes       []string  `json:"routes,omitempty"`
+	SiteRoutes   []string  `json:"site_routes,omitempty"`
+	Endpoint     string    `json:"endpoint,omitempty"`
+	Enabled      bool      `json:"enabled"`
+	CreatedAt    time.Time `json:"created_at"`
 }
 
 var (
-	errPeerExists   = errors.New("peer already exists")
-	errPeerNotFound = errors.New("peer not found")
+	errPeerExists       = errors.New("peer already exists")
+	errInvalidPeerName  = errors.New("invalid peer name: use up to 64 letters, digits, '.', '-' or '_', starting with a letter or digit")
+	errPeerNotFound     = errors.New("peer not found")
+	errPoolExhausted    = errors.New("no available IPs in the address pool")
+	errPublicKeyInUse   = errors.New("public key already in use")
+	errInvalidPublicKey = errors.New("invalid public key: want a base64-encoded 32-byte Curve25519 key")
+	errRouteOverlap     = errors.New("route overlap")
+	errInvalidEndpoint  = errors.New("invalid endpoint: want host:port")
+	errNotMeshPeer      = errors.New("peer has no endpoint and is not part of the mesh")
 )
+
+// peerNamePattern keeps names safe to use in file names and config
+// comments.
+var peerNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+func validatePeerName(name string) error {
+	if !peerNamePattern.MatchString(name) {
+		return errInvalidPeerName
+	}
+	return nil
+}
+
+// HasPrivateKey reports whether the server holds the peer's private key.
+// Peers enrolled with their own public key don't have one.
+func (p *Peer) HasPrivateKey() bool {
+	return p.PrivateKey != ""
+}
+
+// AllowedIPs returns the peer's tunnel addresses, IPv4 first.
+func (p *Peer) AllowedIPs() []string {
+	if p.AllowedIP6 == "" {
+		return []string{p.AllowedIP}
+	}
+	return []string{p.AllowedIP, p.AllowedIP6}
+}
+
+// ServerAllowedIPs returns what the server routes to the peer: its tunnel
+// addresses plus, for site peers, the LAN prefixes behind it.
+func (p *Peer) ServerAllowedIPs() []string {
+	return append(p.AllowedIPs(), p.SiteRoutes...)
+}
+
+// IsSite reports whether the peer is a site router with LANs behind it.
+func (p *Peer) IsSite() bool {
+	return len(p.SiteRoutes) > 0
+}
+
+// IsMesh reports whether the peer has a reachable endpoint and so takes
+// part in the mesh.
+func (p *Peer) IsMesh() bool {
+	return p.Endpoint != ""
+}
+
+// ListenPort returns the port of the peer's mesh endpoint, or "" for peers
+// outside the mesh.
+func (p *Peer) ListenPort() string {
+	if _, port, err := net.SplitHostPort(p.Endpoint); err == nil {
+		return port
+	}
+	return ""
+}
+
+// IP returns the peer's IPv4 tunnel address without the prefix length.
+func (p *Peer) IP() string {
+	return strings.TrimSuffix(p.AllowedIP, "/32")
+}
+
+// IP6 returns the peer's IPv6 tunnel address without the prefix length.
+func (p *Peer) IP6() string {
+	return strings.TrimSuffix(p.AllowedIP6, "/128")
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/netip"
+	"slices"
+	"sort"
+)
+
+// PeerChange is one peer in a SyncPlan. AllowedIPs is what the peer will
+// have; LiveAllowedIPs is what the interface has now. PresharedKey is set
+// when the live preshared key differs from the stored one; the keys
+// themselves are not reported.
+type PeerChange struct {
+	Name           string   `json:"name,omitempty"`
+	PublicKey      string   `json:"public_key"`
+	AllowedIPs     []string `json:"allowed_ips,omitempty"`
+	LiveAllowedIPs []string `json:"live_allowed_ips,omitempty"`
+	PresharedKey   bool     `json:"preshared_key,omitempty"`
+}
+
+// SyncPlan is what a sync would change on the interface.
+type SyncPlan struct {
+	Add    []PeerChange `json:"add"`
+	Remove []PeerChange `json:"remove"`
+	Change []PeerChange `json:"change"`
+}
+
+func (p SyncPlan) Empty() bool {
+	return len(p.Add) == 0 && len(p.Remove) == 0 && len(p.Change) == 0
+}
+
+// planSync compares the desired peers with the live ones by public key,
+// AllowedIPs and preshared key. Endpoints are not compared: the server
+// learns them from handshakes. known names the live peers that are no
+// longer desired, such as disabled peers.
+func planSync(desired []Peer, live []PeerStatus, known []Peer) SyncPlan {
+	plan := SyncPlan{Add: []PeerChange{}, Remove: []PeerChange{}, Change: []PeerChange{}}
+	liveByKey := make(map[string]PeerStatus, len(live))
+	for _, st := range live {
+		liveByKey[st.PublicKey] = st
+	}
+	names := make(map[string]string, len(known))
+	for _, p := range known {
+		names[p.PublicKey] = p.Name
+	}
+
+	wanted := make(map[string]bool, len(desired))
+	for _, peer := range desired {
+		wanted[peer.PublicKey] = true
+		change := PeerChange{Name: peer.Name, PublicKey: peer.PublicKey, AllowedIPs: canonicalPrefixes(peer.ServerAllowedIPs())}
+		st, ok := liveByKey[peer.PublicKey]
+		if !ok {
+			plan.Add = append(plan.Add, change)
+			continue
+		}
+		change.LiveAllowedIPs = canonicalPrefixes(st.AllowedIPs)
+		change.PresharedKey = st.PresharedKey != peer.PresharedKey
+		if change.PresharedKey || !slices.Equal(change.AllowedIPs, change.LiveAllowedIPs) {
+			plan.Change = append(plan.Change, change)
+		}
+	}
+	for _, st := range live {
+		if !wanted[st.PublicKey] {
+			plan.Remove = append(plan.Remove, PeerChange{
+				Name:           names[st.PublicKey],
+				PublicKey:      st.PublicKey,
+				LiveAllowedIPs: canonicalPrefixes(st.AllowedIPs),
+			})
+		}
+	}
+	sort.Slice(plan.Remove, func(i, j int) bool { return plan.Remove[i].PublicKey < plan.Remove[j].PublicKey })
+	return plan
+}
+
+// canonicalPrefixes sorts prefixes and puts them in canonical form so that
+// stored and live AllowedIPs compare equal regardless of how wg prints them.
+func canonicalPrefixes(prefixes []string) []string {
+	out := make([]string, 0, len(prefixes))
+	for _, s := range prefixes {
+		if prefix, err := netip.ParsePrefix(s); err == nil {
+			s = prefix.Masked().String()
+		}
+		out = append(out, s)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// PlanSync reports what Sync would change without applying anything.
+func (m *Manager) PlanSync() (SyncPlan, error) {
+	state, err := m.desiredState()
+	if err != nil {
+		return SyncPlan{}, err
+	}
+	live, err := m.backend.Status()
+	if err != nil {
+		return SyncPlan{}, err
+	}
+	known, err := m.store.ListPeers()
+	if err != nil {
+		return SyncPlan{}, err
+	}
+	return planSync(state.Peers, live, known), nil
+}
+
+// PlanUp reports the peers Up would configure on the new interface.
+func (m *Manager) PlanUp() (SyncPlan, error) {
+	state, err := m.desiredState()
+	if err != nil {
+		return SyncPlan{}, err
+	}
+	return planSync(state.Peers, nil, nil), nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlanSync(t *testing.T) {
+	alice := Peer{Name: "alice", PublicKey: "keyA", AllowedIP: "10.0.0.2/32"}
+	bob := Peer{Name: "bob", PublicKey: "keyB", AllowedIP: "10.0.0.3/32", SiteRoutes: []string{"192.168.50.0/24"}}
+	carol := Peer{Name: "carol", PublicKey: "keyC", AllowedIP: "10.0.0.4/32", PresharedKey: "psk1"}
+
+	tests := []struct {
+		name    string
+		desired []Peer
+		live    []PeerStatus
+		known   []Peer
+		want    SyncPlan
+	}{
+		{
+			name:    "in sync",
+			desired: []Peer{alice, bob},
+			live: []PeerStatus{
+				{PublicKey: "keyA", AllowedIPs: []string{"10.0.0.2/32"}},
+				// wg may list AllowedIPs in another order.
+				{PublicKey: "keyB", AllowedIPs: []string{"192.168.50.0/24", "10.0.0.3/32"}},
+			},
+			want: SyncPlan{Add: []PeerChange{}, Remove: []PeerChange{}, Change: []PeerChange{}},
+		},
+		{
+			name:    "add",
+			desired: []Peer{alice, bob},
+			live:    []PeerStatus{{PublicKey: "keyA", AllowedIPs: []string{"10.0.0.2/32"}}},
+			want: SyncPlan{
+				Add:    []PeerChange{{Name: "bob", PublicKey: "keyB", AllowedIPs: []string{"10.0.0.3/32", "192.168.50.0/24"}}},
+				Remove: []PeerChange{},
+				Change: []PeerChange{},
+			},
+		},
+		{
+			name:    "remove known and unknown peers",
+			desired: []Peer{alice},
+			live: []PeerStatus{
+				{PublicKey: "keyA", AllowedIPs: []string{"10.0.0.2/32"}},
+				{PublicKey: "keyZ", AllowedIPs: []string{"10.0.0.9/32"}},
+				{PublicKey: "keyB", AllowedIPs: []string{"10.0.0.3/32"}},
+			},
+			known: []Peer{alice, bob},
+			want: SyncPlan{
+				Add: []PeerChange{},
+				Remove: []PeerChange{
+					{Name: "bob", PublicKey: "keyB", LiveAllowedIPs: []string{"10.0.0.3/32"}},
+					{PublicKey: "keyZ", LiveAllowedIPs: []string{"10.0.0.9/32"}},
+				},
+				Change: []PeerChange{},
+			},
+		},
+		{
+			name:    "change AllowedIPs",
+			desired: []Peer{bob},
+			live:    []PeerStatus{{PublicKey: "keyB", AllowedIPs: []string{"10.0.0.3/32"}}},
+			want: SyncPlan{
+				Add:    []PeerChange{},
+				Remove: []PeerChange{},
+				Change: []PeerChange{{
+					Name:           "bob",
+					PublicKey:      "keyB",
+					AllowedIPs:     []string{"10.0.0.3/32", "192.168.50.0/24"},
+					LiveAllowedIPs: []string{"10.0.0.3/32"},
+				}},
+			},
+		},
+		{
+			name:    "change preshared key",
+			desired: []Peer{carol},
+			live:    []PeerStatus{{PublicKey: "keyC", PresharedKey: "psk0", AllowedIPs: []string{"10.0.0.4/32"}}},
+			want: SyncPlan{
+				Add:    []PeerChange{},
+				Remove: []PeerChange{},
+				Change: []PeerChange{{
+					Name:           "carol",
+					PublicKey:      "keyC",
+					AllowedIPs:     []string{"10.0.0.4/32"},
+					LiveAllowedIPs: []string{"10.0.0.4/32"},
+					PresharedKey:   true,
+				}},
+			},
+		},
+		{
+			name:    "up from nothing",
+			desired: []Peer{alice},
+			want: SyncPlan{
+				Add:    []PeerChange{{Name: "alice", PublicKey: "keyA", AllowedIPs: []string{"10.0.0.2/32"}}},
+				Remove: []PeerChange{},
+				Change: []PeerChange{},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := planSync(tt.desired, tt.live, tt.known)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("planSync:\n got %+v\nwant %+v", got, tt.want)
+			}
+			if got.Empty() != (len(tt.want.Add)+len(tt.want.Remove)+len(tt.want.Change) == 0) {
+				t.Errorf("Empty() = %v for %+v", got.Empty(), got)
+			}
+		})
+	}
+}
+
+func TestDescribeChange(t *testing.T) {
+	ip := []string{"10.0.0.2/32"}
+	tests := []struct {
+		name   string
+		change PeerChange
+		want   string
+	}{
+		{"allowed IPs", PeerChange{AllowedIPs: []string{"10.0.0.2/32", "192.168.50.0/24"}, LiveAllowedIPs: ip}, "10.0.0.2/32 -> 10.0.0.2/32, 192.168.50.0/24"},
+		{"preshared key", PeerChange{AllowedIPs: ip, LiveAllowedIPs: ip, PresharedKey: true}, "10.0.0.2/32 (preshared key)"},
+		{"both", PeerChange{AllowedIPs: []string{"10.0.0.3/32"}, LiveAllowedIPs: ip, PresharedKey: true}, "10.0.0.2/32 -> 10.0.0.3/32 (preshared key)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := describeChange(tt.change); got != tt.want {
+				t.Errorf("describeChange = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
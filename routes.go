@@ -0,0 +1,245 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+var errInvalidRoute = errors.New("invalid route")
+
+// parseRoutes parses a comma-separated list of CIDR prefixes, as given to
+// --routes, into their canonical form. Host bits are rejected rather than
+// silently masked off, since they usually mean a typo.
+func parseRoutes(s string) ([]string, error) {
+	var routes []string
+	seen := make(map[string]bool)
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			return nil, fmt.Errorf("%w %q: want a CIDR prefix such as 10.20.0.0/16", errInvalidRoute, field)
+		}
+		if prefix.Masked() != prefix {
+			return nil, fmt.Errorf("%w %q: host bits set (did you mean %s?)", errInvalidRoute, field, prefix.Masked())
+		}
+		if !seen[prefix.String()] {
+			seen[prefix.String()] = true
+			routes = append(routes, prefix.String())
+		}
+	}
+	return routes, nil
+}
+
+// clientAllowedIPs returns what a client routes through the tunnel: the
+// peer's own routes, else the server-wide default, else everything. Split
+// tunnels also get the tunnel subnets so the server and its DNS stay
+// reachable.
+func clientAllowedIPs(cfg *Config, peer *Peer) []string {
+	routes := peer.Routes
+	if len(routes) == 0 {
+		routes = cfg.ClientRoutes
+	}
+	if len(routes) == 0 {
+		if peer.AllowedIP6 != "" {
+			return []string{"0.0.0.0/0", "::/0"}
+		}
+		return []string{"0.0.0.0/0"}
+	}
+
+	out := append([]string(nil), routes...)
+	for _, addr := range cfg.Addresses() {
+		prefix, err := netip.ParsePrefix(addr)
+		if err != nil {
+			continue
+		}
+		if !routesCover(out, prefix.Masked()) {
+			out = append(out, prefix.Masked().String())
+		}
+	}
+	return out
+}
+
+// routesCover reports whether one of routes contains all of prefix.
+func routesCover(routes []string, prefix netip.Prefix) bool {
+	parsed := make([]netip.Prefix, 0, len(routes))
+	for _, r := range routes {
+		if rp, err := netip.ParsePrefix(r); err == nil {
+			parsed = append(parsed, rp)
+		}
+	}
+	return prefixCovered(parsed, prefix)
+}
+
+func prefixCovered(prefixes []netip.Prefix, prefix netip.Prefix) bool {
+	for _, p := range prefixes {
+		if p.Bits() <= prefix.Bits() && p.Contains(prefix.Addr()) {
+			return true
+		}
+	}
+	return false
+}
+
+// siteClientAllowedIPs is clientAllowedIPs for a site peer. A site router
+// should not send its LAN's internet traffic through the hub, so unless it
+// has routes of its own it gets the tunnel subnets and the other sites
+// instead of the road-warrior default.
+func siteClientAllowedIPs(cfg *Config, peer *Peer, sites []Peer) []string {
+	var out []string
+	if len(peer.Routes) > 0 {
+		out = clientAllowedIPs(cfg, peer)
+	} else {
+		for _, addr := range cfg.Addresses() {
+			if prefix, err := netip.ParsePrefix(addr); err == nil {
+				out = append(out, prefix.Masked().String())
+			}
+		}
+	}
+	for _, site := range sites {
+		if site.ID == peer.ID {
+			continue
+		}
+		for _, r := range site.SiteRoutes {
+			prefix, err := netip.ParsePrefix(r)
+			if err != nil || routesCover(out, prefix) {
+				continue
+			}
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// siteRoutes returns the LAN prefixes of all site peers, which the server
+// needs kernel routes for.
+func siteRoutes(peers []Peer) []netip.Prefix {
+	var out []netip.Prefix
+	for _, p := range peers {
+		for _, r := range p.SiteRoutes {
+			if prefix, err := netip.ParsePrefix(r); err == nil {
+				out = append(out, prefix)
+			}
+		}
+	}
+	return out
+}
+
+// checkSiteRoutesTx rejects site prefixes that overlap each other, the
+// address pools or another peer's sites; any of those would make the server
+// route the same addresses to two places.
+func checkSiteRoutesTx(tx *sql.Tx, cidr, cidr6 string, sites []string) error {
+	if len(sites) == 0 {
+		return nil
+	}
+
+	type owned struct {
+		prefix netip.Prefix
+		owner  string
+	}
+	var existing []owned
+	for _, pool := range []string{cidr, cidr6} {
+		if pool == "" {
+			continue
+		}
+		_, prefix, err := parsePool(pool, strings.Contains(pool, ":"))
+		if err != nil {
+			return err
+		}
+		existing = append(existing, owned{prefix, "the address pool"})
+	}
+
+	rows, err := tx.Query("SELECT name, site_routes FROM peers WHERE site_routes IS NOT NULL")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var name, routes string
+		if err := rows.Scan(&name, &routes); err != nil {
+			rows.Close()
+			return err
+		}
+		for _, r := range strings.Split(routes, ",") {
+			if prefix, err := netip.ParsePrefix(r); err == nil {
+				existing = append(existing, owned{prefix, "peer " + name})
+			}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, r := range sites {
+		prefix, err := netip.ParsePrefix(r)
+		if err != nil {
+			return fmt.Errorf("%w %q", errInvalidRoute, r)
+		}
+		for _, o := range existing {
+			if prefix.Overlaps(o.prefix) {
+				return fmt.Errorf("%w: %s overlaps %s of %s", errRouteOverlap, prefix, o.prefix, o.owner)
+			}
+		}
+		existing = append(existing, owned{prefix, "this peer"})
+	}
+	return nil
+}
+
+// staleRoutes returns the routes in current that were applied as site
+// routes before and are no longer wanted. Routes added by hand or by other
+// tools are left alone.
+func staleRoutes(current, desired, applied []netip.Prefix) []netip.Prefix {
+	var stale []netip.Prefix
+	for _, r := range current {
+		if slices.Contains(applied, r) && !slices.Contains(desired, r) {
+			stale = append(stale, r)
+		}
+	}
+	return stale
+}
+
+// AppliedRoutes returns the site prefixes last routed to the interface.
+func (s *Store) AppliedRoutes() ([]netip.Prefix, error) {
+	rows, err := s.db.Query("SELECT prefix FROM applied_routes ORDER BY prefix")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []netip.Prefix
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			return nil, err
+		}
+		if prefix, err := netip.ParsePrefix(p); err == nil {
+			out = append(out, prefix)
+		}
+	}
+	return out, rows.Err()
+}
+
+// SetAppliedRoutes replaces the record of site prefixes routed to the
+// interface.
+func (s *Store) SetAppliedRoutes(prefixes []netip.Prefix) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM applied_routes"); err != nil {
+		return err
+	}
+	for _, p := range prefixes {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO applied_routes (prefix) VALUES (?)", p.String()); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func prefixes(ss ...string) []netip.Prefix {
+	out := make([]netip.Prefix, 0, len(ss))
+	for _, s := range ss {
+		out = append(out, netip.MustParsePrefix(s))
+	}
+	return out
+}
+
+func TestStaleRoutes(t *testing.T) {
+	tests := []struct {
+		name                      string
+		current, desired, applied []netip.Prefix
+		want                      []netip.Prefix
+	}{
+		{
+			name:    "removed site",
+			current: prefixes("192.168.50.0/24", "192.168.60.0/24"),
+			desired: prefixes("192.168.50.0/24"),
+			applied: prefixes("192.168.50.0/24", "192.168.60.0/24"),
+			want:    prefixes("192.168.60.0/24"),
+		},
+		{
+			name:    "manual route kept",
+			current: prefixes("192.168.50.0/24", "172.16.0.0/12"),
+			desired: nil,
+			applied: prefixes("192.168.50.0/24"),
+			want:    prefixes("192.168.50.0/24"),
+		},
+		{
+			name:    "applied route already gone",
+			current: nil,
+			desired: nil,
+			applied: prefixes("192.168.50.0/24"),
+			want:    nil,
+		},
+		{
+			name:    "nothing recorded",
+			current: prefixes("192.168.50.0/24"),
+			desired: nil,
+			applied: nil,
+			want:    nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := staleRoutes(tt.current, tt.desired, tt.applied)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("staleRoutes = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestManagerRecordsAppliedRoutes(t *testing.T) {
+	mgr, _ := newTestManager(t, &Config{Interface: "wg0", Address: "10.0.0.1/24"})
+	if err := mgr.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := mgr.AddPeer("branch", PeerOptions{SiteRoutes: []string{"192.168.50.0/24"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mgr.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	applied, err := mgr.store.AppliedRoutes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := prefixes("192.168.50.0/24"); !slices.Equal(applied, want) {
+		t.Errorf("after add: applied routes = %v, want %v", applied, want)
+	}
+
+	if _, err := mgr.RemovePeer("branch"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mgr.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if applied, err = mgr.store.AppliedRoutes(); err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 0 {
+		t.Errorf("after remove: applied routes = %v, want none", applied)
+	}
+}
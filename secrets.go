@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Private keys are stored with envelope encryption: a random data key
+// encrypts the secrets, and the data key itself is stored in config.json
+// wrapped by a master key that never touches the data dir.
+
+const (
+	keySourceEnv        = "env"
+	keySourceFile       = "file"
+	keySourcePassphrase = "passphrase"
+
+	masterKeyEnv        = "VPN_MASTER_KEY"
+	masterPassphraseEnv = "VPN_MASTER_PASSPHRASE"
+
+	sealedPrefix     = "enc:v1:"
+	pbkdf2Iterations = 600000
+)
+
+var errNoMasterKey = errors.New("stored keys are encrypted but no master key is configured")
+
+// EncryptionConfig describes where the master key comes from and holds the
+// wrapped data key.
+type EncryptionConfig struct {
+	// KeySource is "env" (VPN_MASTER_KEY), "file" (KeyFile) or
+	// "passphrase" (prompted, or VPN_MASTER_PASSPHRASE).
+	KeySource  string `json:"key_source"`
+	KeyFile    string `json:"key_file,omitempty"`
+	Salt       string `json:"salt,omitempty"`
+	WrappedKey string `json:"wrapped_key"`
+}
+
+// sealer encrypts and decrypts individual secrets with the data key.
+type sealer struct {
+	aead cipher.AEAD
+}
+
+func newSealer(key []byte) (*sealer, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &sealer{aead: aead}, nil
+}
+
+func (s *sealer) sealBytes(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("generate nonce: %w", err)
+	}
+	return s.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (s *sealer) openBytes(sealed []byte) ([]byte, error) {
+	if len(sealed) < s.aead.NonceSize() {
+		return nil, errors.New("sealed value too short")
+	}
+	nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	return s.aead.Open(nil, nonce, ciphertext, nil)
+}
+
+// seal encrypts a secret for storage. Empty values stay empty. A nil sealer
+// stores secrets as they are.
+func (s *sealer) seal(secret string) (string, error) {
+	if s == nil || secret == "" || isSealed(secret) {
+		return secret, nil
+	}
+	sealed, err := s.sealBytes([]byte(secret))
+	if err != nil {
+		return "", err
+	}
+	return sealedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// open decrypts a stored secret. Values without the sealed prefix are
+// plaintext from before encryption was enabled and are returned unchanged.
+func (s *sealer) open(stored string) (string, error) {
+	if !isSealed(stored) {
+		return stored, nil
+	}
+	if s == nil {
+		return "", errNoMasterKey
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, sealedPrefix))
+	if err != nil {
+		return "", fmt.Errorf("decode sealed value: %w", err)
+	}
+	plaintext, err := s.openBytes(sealed)
+	if err != nil {
+		return "", fmt.Errorf("decrypt stored key: %w", err)
+	}
+	return string(plaintext), nil
+}
+
+func isSealed(s string) bool {
+	return strings.HasPrefix(s, sealedPrefix)
+}
+
+// unlockStorage derives the master key described by enc and unwraps the
+// data key with it.
+func unlockStorage(enc *EncryptionConfig) (*sealer, error) {
+	kek, err := masterKey(enc, false)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(enc.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("decode wrapped key: %w", err)
+	}
+	kekSealer, err := newSealer(kek)
+	if err != nil {
+		return nil, err
+	}
+	dek, err := kekSealer.openBytes(wrapped)
+	if err != nil {
+		return nil, errors.New("wrong master key: cannot unwrap storage key")
+	}
+	return newSealer(dek)
+}
+
+// wrapStorageKey wraps dek with the master key described by enc and stores
+// the result in enc.WrappedKey.
+func wrapStorageKey(enc *EncryptionConfig, dek []byte) error {
+	kek, err := masterKey(enc, true)
+	if err != nil {
+		return err
+	}
+	kekSealer, err := newSealer(kek)
+	if err != nil {
+		return err
+	}
+	wrapped, err := kekSealer.sealBytes(dek)
+	if err != nil {
+		return err
+	}
+	enc.WrappedKey = base64.StdEncoding.EncodeToString(wrapped)
+	return nil
+}
+
+// masterKey resolves the 32-byte master key. When creating is set, a
+// missing key file is generated and a passphrase is asked for twice.
+func masterKey(enc *EncryptionConfig, creating bool) ([]byte, error) {
+	switch enc.KeySource {
+	case keySourceEnv:
+		value := os.Getenv(masterKeyEnv)
+		if value == "" {
+			return nil, fmt.Errorf("%s is not set", masterKeyEnv)
+		}
+		return decodeMasterKey(value)
+	case keySourceFile:
+		if enc.KeyFile == "" {
+			return nil, errors.New("no master key file configured")
+		}
+		data, err := os.ReadFile(enc.KeyFile)
+		if errors.Is(err, os.ErrNotExist) && creating {
+			return createKeyFile(enc.KeyFile)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read master key file: %w", err)
+		}
+		return decodeMasterKey(string(data))
+	case keySourcePassphrase:
+		salt, err := base64.StdEncoding.DecodeString(enc.Salt)
+		if err != nil || len(salt) == 0 {
+			return nil, errors.New("missing passphrase salt")
+		}
+		passphrase := os.Getenv(masterPassphraseEnv)
+		if passphrase == "" {
+			if passphrase, err = readPassphrase("Master passphrase: "); err != nil {
+				return nil, err
+			}
+			if creating {
+				again, err := readPassphrase("Repeat passphrase: ")
+				if err != nil {
+					return nil, err
+				}
+				if again != passphrase {
+					return nil, errors.New("passphrases do not match")
+				}
+			}
+		}
+		if passphrase == "" {
+			return nil, errors.New("empty passphrase")
+		}
+		return pbkdf2.Key(sha256.New, passphrase, salt, pbkdf2Iterations, 32)
+	default:
+		return nil, fmt.Errorf("unknown master key source %q", enc.KeySource)
+	}
+}
+
+func decodeMasterKey(value string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("master key must be 32 bytes, base64-encoded")
+	}
+	return key, nil
+}
+
+func createKeyFile(path string) ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("generate master key: %w", err)
+	}
+	data := base64.StdEncoding.EncodeToString(key) + "\n"
+	if err := os.WriteFile(path, []byte(data), 0400); err != nil {
+		return nil, fmt.Errorf("write master key file: %w", err)
+	}
+	return key, nil
+}
+
+// passphraseInput is shared by all prompts: a reader buffers past the
+// first line, so with piped stdin a second reader would miss the repeat.
+var passphraseInput = bufio.NewReader(os.Stdin)
+
+// readPassphrase prompts on stderr and reads a line from stdin with echo
+// turned off when stdin is a terminal.
+func readPassphrase(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	if err := setEcho(false); err == nil {
+		defer func() {
+			_ = setEcho(true)
+			fmt.Fprintln(os.Stderr)
+		}()
+	}
+	line, err := passphraseInput.ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("read passphrase: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func setEcho(on bool) error {
+	arg := "-echo"
+	if on {
+		arg = "echo"
+	}
+	cmd := exec.Command("stty", arg)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
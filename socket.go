@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// The API can also be served on a Unix socket for tooling on the VPN host.
+// Callers there are identified by the kernel (SO_PEERCRED) rather than by
+// a token: a caller whose uid or primary gid is allowed gets the same
+// unrestricted access as the CLI. Supplementary groups are not considered:
+// SO_PEERCRED does not report them, and looking them up by pid races with
+// the pid being reused.
+
+// peerCred identifies the process on the other end of a Unix socket.
+type peerCred struct {
+	UID uint32
+	GID uint32
+	PID int32
+}
+
+// socketAccess lists the local callers the socket accepts.
+type socketAccess struct {
+	UIDs []uint32
+	GIDs []uint32
+}
+
+func (s socketAccess) allows(cred *peerCred) bool {
+	return cred.UID == 0 || slices.Contains(s.UIDs, cred.UID) || slices.Contains(s.GIDs, cred.GID)
+}
+
+type peerCredKey struct{}
+
+type localCallerKey struct{}
+
+// socketConnContext records the caller's credentials with each connection
+// so handlers can see them.
+func socketConnContext(ctx context.Context, conn net.Conn) context.Context {
+	cred, err := peerCredentials(conn)
+	if err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, peerCredKey{}, cred)
+}
+
+// RequireLocal wraps the socket's handler so that only allowed callers
+// reach it. Those that do skip token checks in Require.
+func (a *APIServer) RequireLocal(access socketAccess, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cred, ok := r.Context().Value(peerCredKey{}).(*peerCred)
+		if !ok {
+			writeHTTPError(w, r, http.StatusForbidden, "forbidden", "Unable to identify caller")
+			return
+		}
+		if !access.allows(cred) {
+			writeHTTPError(w, r, http.StatusForbidden, "forbidden", fmt.Sprintf("uid %d is not allowed to use this socket", cred.UID))
+			return
+		}
+		local := r.WithContext(context.WithValue(r.Context(), localCallerKey{}, cred))
+		next.ServeHTTP(w, local)
+		// The mux records the matched pattern on the copy; hand it back for
+		// Instrument, which wraps this handler.
+		r.Pattern = local.Pattern
+	})
+}
+
+func isLocalCaller(r *http.Request) bool {
+	_, ok := r.Context().Value(localCallerKey{}).(*peerCred)
+	return ok
+}
+
+// listenSocket creates the socket at path with the given owner, group and
+// mode. A stale socket left by an earlier run is replaced; any other file
+// is not.
+func listenSocket(path string, uid, gid int, mode fs.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&fs.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chown(path, uid, gid); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("chown socket: %w", err)
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("chmod socket: %w", err)
+	}
+	return ln, nil
+}
+
+// lookupUID accepts a user name or a numeric uid.
+func lookupUID(s string) (uint32, error) {
+	if id, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(id), nil
+	}
+	u, err := user.Lookup(s)
+	if err != nil {
+		return 0, err
+	}
+	id, err := strconv.ParseUint(u.Uid, 10, 32)
+	return uint32(id), err
+}
+
+// lookupGID accepts a group name or a numeric gid.
+func lookupGID(s string) (uint32, error) {
+	if id, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(id), nil
+	}
+	g, err := user.LookupGroup(s)
+	if err != nil {
+		return 0, err
+	}
+	id, err := strconv.ParseUint(g.Gid, 10, 32)
+	return uint32(id), err
+}
+
+// parseIDList resolves a comma-separated list of names or ids.
+func parseIDList(s string, lookup func(string) (uint32, error)) ([]uint32, error) {
+	var ids []uint32
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		id, err := lookup(name)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
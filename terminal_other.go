@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// stdinIsTerminal reports whether stdin is a character device, which is a
+// terminal in practice.
+func stdinIsTerminal() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
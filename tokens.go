@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// API tokens authenticate REST clients. Only a SHA-256 hash of each token
+// is stored; the token itself is shown once, when it is created. Tokens
+// are random 256-bit values, so a plain hash is enough to make a stolen
+// database useless for calling the API.
+
+// APIToken is a stored token without its secret.
+type APIToken struct {
+	Name string `json:"name"`
+	// User, if set, is the user the token acts as; its role limits what
+	// the scopes allow.
+	User       string    `json:"user,omitempty"`
+	Scopes     []string  `json:"scopes"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
+const (
+	scopePeersRead   = "peers:read"
+	scopePeersWrite  = "peers:write"
+	scopeGroupsRead  = "groups:read"
+	scopeGroupsWrite = "groups:write"
+	scopeMetricsRead = "metrics:read"
+
+	tokenPrefix = "vpn_"
+)
+
+var allScopes = []string{scopePeersRead, scopePeersWrite, scopeGroupsRead, scopeGroupsWrite, scopeMetricsRead}
+
+var (
+	errTokenExists      = errors.New("token already exists")
+	errTokenNotFound    = errors.New("token not found")
+	errInvalidToken     = errors.New("invalid token")
+	errInvalidTokenName = errors.New("invalid token name: use up to 64 letters, digits, '.', '-' or '_'")
+	errInvalidScope     = errors.New("invalid scope")
+)
+
+var tokenNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+// parseScopes parses a comma-separated scope list.
+func parseScopes(s string) ([]string, error) {
+	var scopes []string
+	for _, scope := range strings.Split(s, ",") {
+		scope = strings.TrimSpace(scope)
+		if scope == "" {
+			continue
+		}
+		if !slices.Contains(allScopes, scope) {
+			return nil, fmt.Errorf("%w %q: use %s", errInvalidScope, scope, strings.Join(allScopes, ", "))
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("%w: at least one scope is required", errInvalidScope)
+	}
+	return scopes, nil
+}
+
+// HasScope reports whether the token grants scope. A write scope also
+// grants reading the same resource.
+func (t *APIToken) HasScope(scope string) bool {
+	if slices.Contains(t.Scopes, scope) {
+		return true
+	}
+	if resource, ok := strings.CutSuffix(scope, ":read"); ok {
+		return slices.Contains(t.Scopes, resource+":write")
+	}
+	return false
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate token: %w", err)
+	}
+	return tokenPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// CreateToken stores a new token for user, which may be empty, and returns
+// its secret, which cannot be recovered later.
+func (s *Store) CreateToken(name, user string, scopes []string) (string, error) {
+	if !tokenNamePattern.MatchString(name) {
+		return "", errInvalidTokenName
+	}
+	var exists int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM api_tokens WHERE name = ?", name).Scan(&exists); err != nil {
+		return "", err
+	}
+	if exists > 0 {
+		return "", errTokenExists
+	}
+	if user != "" {
+		if err := s.db.QueryRow("SELECT COUNT(*) FROM users WHERE name = ?", user).Scan(&exists); err != nil {
+			return "", err
+		}
+		if exists == 0 {
+			return "", errUserNotFound
+		}
+	}
+	token, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+	_, err = s.db.Exec("INSERT INTO api_tokens (name, user_name, token_hash, scopes, created_at) VALUES (?, ?, ?, ?, ?)",
+		name, nullString(user), hashToken(token), strings.Join(scopes, ","), time.Now().Unix())
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (s *Store) RevokeToken(name string) error {
+	result, err := s.db.Exec("DELETE FROM api_tokens WHERE name = ?", name)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return errTokenNotFound
+	}
+	return nil
+}
+
+func (s *Store) ListTokens() ([]APIToken, error) {
+	rows, err := s.db.Query("SELECT name, user_name, scopes, created_at, last_used_at FROM api_tokens ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []APIToken{}
+	for rows.Next() {
+		t, err := scanToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, *t)
+	}
+	return tokens, rows.Err()
+}
+
+// AuthenticateToken returns the token matching the secret and records that
+// it was used.
+func (s *Store) AuthenticateToken(secret string) (*APIToken, error) {
+	hash := hashToken(secret)
+	row := s.db.QueryRow("SELECT name, user_name, scopes, created_at, last_used_at FROM api_tokens WHERE token_hash = ?", hash)
+	t, err := scanToken(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if _, err := s.db.Exec("UPDATE api_tokens SET last_used_at = ? WHERE token_hash = ?", now.Unix(), hash); err != nil {
+		return nil, err
+	}
+	t.LastUsedAt = now
+	return t, nil
+}
+
+func scanToken(row rowScanner) (*APIToken, error) {
+	var t APIToken
+	var user sql.NullString
+	var scopes string
+	var created int64
+	var lastUsed sql.NullInt64
+	if err := row.Scan(&t.Name, &user, &scopes, &created, &lastUsed); err != nil {
+		return nil, err
+	}
+	t.User = user.String
+	t.Scopes = strings.Split(scopes, ",")
+	t.CreatedAt = time.Unix(created, 0)
+	if lastUsed.Valid {
+		t.LastUsedAt = time.Unix(lastUsed.Int64, 0)
+	}
+	return &t, nil
+}
+
+func (m *Manager) CreateToken(name, user string, scopes []string) (string, error) {
+	if err := m.require(roleAdmin); err != nil {
+		return "", err
+	}
+	return m.store.CreateToken(name, user, scopes)
+}
+
+func (m *Manager) RevokeToken(name string) error {
+	if err := m.require(roleAdmin); err != nil {
+		return err
+	}
+	return m.store.RevokeToken(name)
+}
+
+func (m *Manager) ListTokens() ([]APIToken, error) {
+	return m.store.ListTokens()
+}
+
+func (m *Manager) AuthenticateToken(secret string) (*APIToken, error) {
+	return m.store.AuthenticateToken(secret)
+}
+
+type userKey struct{}
+
+// manager returns the Manager to serve r with: one acting as the token's
+// user, if it has one.
+func (a *APIServer) manager(r *http.Request) *Manager {
+	if user, ok := r.Context().Value(userKey{}).(*User); ok {
+		return a.mgr.As(user)
+	}
+	return a.mgr
+}
+
+// Require wraps a handler so that it only runs for requests carrying a
+// bearer token with the given scope, or coming from an allowed caller on
+// the Unix socket.
+func (a *APIServer) Require(scope string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if isLocalCaller(r) {
+			h(w, r)
+			return
+		}
+		secret, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || secret == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="vpn"`)
+			writeHTTPError(w, r, http.StatusUnauthorized, "unauthorized", "Authentication required")
+			return
+		}
+		token, err := a.mgr.AuthenticateToken(strings.TrimSpace(secret))
+		if err != nil {
+			if errors.Is(err, errInvalidToken) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="vpn", error="invalid_token"`)
+				writeHTTPError(w, r, http.StatusUnauthorized, "invalid_token", "Invalid token")
+				return
+			}
+			writeHTTPError(w, r, http.StatusInternalServerError, "internal", "Failed to check token")
+			return
+		}
+		if !token.HasScope(scope) {
+			writeHTTPError(w, r, http.StatusForbidden, "insufficient_scope", "Token lacks scope "+scope)
+			return
+		}
+		if token.User != "" {
+			user, err := a.mgr.GetUser(token.User)
+			if err != nil {
+				writeHTTPError(w, r, http.StatusInternalServerError, "internal", "Failed to load token user")
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), userKey{}, user))
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UsageBucket is the traffic of one peer over one hour or day (UTC).
+type UsageBucket struct {
+	Start   time.Time `json:"start"`
+	RxBytes int64     `json:"rx_bytes"`
+	TxBytes int64     `json:"tx_bytes"`
+}
+
+const (
+	usageByHour = "hour"
+	usageByDay  = "day"
+)
+
+// RecordUsage stores the traffic since the previous sample for each peer in
+// samples. WireGuard counters restart at zero when the interface goes down,
+// so a counter lower than the last one seen is taken as a reset and counted
+// from zero. Samples for unknown public keys are ignored.
+func (s *Store) RecordUsage(samples []PeerStatus, now time.Time) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	ids := make(map[string]string)
+	rows, err := tx.Query("SELECT id, public_key FROM peers")
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var id, pubKey string
+		if err := rows.Scan(&id, &pubKey); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids[pubKey] = id
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	recorded := 0
+	ts := now.Unix()
+	for _, sample := range samples {
+		id, ok := ids[sample.PublicKey]
+		if !ok {
+			continue
+		}
+
+		var lastRx, lastTx int64
+		err := tx.QueryRow("SELECT rx_bytes, tx_bytes FROM peer_counters WHERE peer_id = ?", id).Scan(&lastRx, &lastTx)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return 0, err
+		}
+		rxDelta, txDelta := sample.RxBytes-lastRx, sample.TxBytes-lastTx
+		if rxDelta < 0 || txDelta < 0 {
+			rxDelta, txDelta = sample.RxBytes, sample.TxBytes
+		}
+
+		if _, err := tx.Exec(`INSERT INTO peer_counters (peer_id, rx_bytes, tx_bytes, sampled_at) VALUES (?, ?, ?, ?)
+			ON CONFLICT(peer_id) DO UPDATE SET rx_bytes = excluded.rx_bytes, tx_bytes = excluded.tx_bytes, sampled_at = excluded.sampled_at`,
+			id, sample.RxBytes, sample.TxBytes, ts); err != nil {
+			return 0, err
+		}
+		if rxDelta == 0 && txDelta == 0 {
+			continue
+		}
+		if _, err := tx.Exec("INSERT INTO peer_usage (peer_id, sampled_at, rx_bytes, tx_bytes) VALUES (?, ?, ?, ?)",
+			id, ts, rxDelta, txDelta); err != nil {
+			return 0, err
+		}
+		recorded++
+	}
+
+	return recorded, tx.Commit()
+}
+
+// Usage returns the peer's traffic since the given time, rolled up into
+// hourly or daily buckets. A removed peer's usage is found by its name
+// unless a current peer has taken the name over.
+func (s *Store) Usage(name string, since time.Time, by string) ([]UsageBucket, error) {
+	var width int64
+	switch by {
+	case usageByHour:
+		width = int64(time.Hour / time.Second)
+	case usageByDay:
+		width = int64(24 * time.Hour / time.Second)
+	default:
+		return nil, fmt.Errorf("unknown rollup %q (want hour or day)", by)
+	}
+
+	id, err := s.usagePeerID(name)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(`SELECT (sampled_at / ?) * ? AS bucket, SUM(rx_bytes), SUM(tx_bytes)
+		FROM peer_usage WHERE peer_id = ? AND sampled_at >= ?
+		GROUP BY bucket ORDER BY bucket`, width, width, id, since.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var buckets []UsageBucket
+	for rows.Next() {
+		var start int64
+		var b UsageBucket
+		if err := rows.Scan(&start, &b.RxBytes, &b.TxBytes); err != nil {
+			return nil, err
+		}
+		b.Start = time.Unix(start, 0).UTC()
+		buckets = append(buckets, b)
+	}
+	return buckets, rows.Err()
+}
+
+// usagePeerID returns the ID of the peer called name, or of the most
+// recently removed peer of that name.
+func (s *Store) usagePeerID(name string) (string, error) {
+	var id string
+	err := s.db.QueryRow("SELECT id FROM peers WHERE name = ?", name).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = s.db.QueryRow("SELECT id FROM removed_peers WHERE name = ? ORDER BY removed_at DESC, rowid DESC LIMIT 1", name).Scan(&id)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", errPeerNotFound
+	}
+	return id, err
+}
+
+// CollectUsage samples the live counters once and records the deltas.
+func (m *Manager) CollectUsage() (int, error) {
+	statuses, err := m.backend.Status()
+	if err != nil {
+		return 0, err
+	}
+	return m.store.RecordUsage(statuses, time.Now())
+}
+
+func (m *Manager) Usage(name string, since time.Time, by string) ([]UsageBucket, error) {
+	return m.store.Usage(name, since, by)
+}
+
+// parseSince accepts a lookback such as "30d", "12h" or "90m", or an
+// absolute date (2006-01-02) or RFC 3339 timestamp.
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || days < 0 {
+			return time.Time{}, fmt.Errorf("invalid duration %q", s)
+		}
+		return now.AddDate(0, 0, -days), nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid since %q (use e.g. 30d, 12h or 2006-01-02)", s)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestUsageOfRemovedPeer(t *testing.T) {
+	mgr, _ := newTestManager(t, &Config{Interface: "wg0", Address: "10.0.0.1/24"})
+	store := mgr.store
+	now := time.Date(2026, 1, 2, 10, 30, 0, 0, time.UTC)
+
+	record := func(pubKey string, rx int64) {
+		t.Helper()
+		if _, err := store.RecordUsage([]PeerStatus{{PublicKey: pubKey, RxBytes: rx}}, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rxTotal := func(name string) int64 {
+		t.Helper()
+		buckets, err := store.Usage(name, now.Add(-time.Hour), usageByDay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rx int64
+		for _, b := range buckets {
+			rx += b.RxBytes
+		}
+		return rx
+	}
+
+	old, _, err := mgr.AddPeer("alice", PeerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	record(old.PublicKey, 100)
+	if _, err := mgr.RemovePeer("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if got := rxTotal("alice"); got != 100 {
+		t.Errorf("removed peer rx = %d, want 100", got)
+	}
+
+	// A new peer with the same name takes the name over.
+	reused, _, err := mgr.AddPeer("alice", PeerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	record(reused.PublicKey, 7)
+	if got := rxTotal("alice"); got != 7 {
+		t.Errorf("new peer rx = %d, want 7", got)
+	}
+
+	if _, err := store.Usage("nobody", now, usageByDay); !errors.Is(err, errPeerNotFound) {
+		t.Errorf("unknown peer error = %v, want %v", err, errPeerNotFound)
+	}
+}
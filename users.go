@@ -0,0 +1,329 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Users give API tokens a role. A viewer may only read; an operator may
+// also add, remove, enable and disable peers, but only in the groups it
+// owns; an admin may do everything, including managing groups, policies,
+// users and tokens. The checks live in Manager, so every caller is held to
+// them, not just the REST API. The CLI acts without a user: whoever can
+// open the database is an admin anyway.
+type User struct {
+	Name      string    `json:"name"`
+	Role      string    `json:"role"`
+	Groups    []string  `json:"groups"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const (
+	roleViewer   = "viewer"
+	roleOperator = "operator"
+	roleAdmin    = "admin"
+)
+
+// roles is ordered from least to most privileged.
+var roles = []string{roleViewer, roleOperator, roleAdmin}
+
+var (
+	errUserExists   = errors.New("user already exists")
+	errUserNotFound = errors.New("user not found")
+	errInvalidRole  = errors.New("invalid role: use viewer, operator or admin")
+	errForbidden    = errors.New("permission denied")
+)
+
+func validateRole(role string) error {
+	if !slices.Contains(roles, role) {
+		return errInvalidRole
+	}
+	return nil
+}
+
+// atLeast reports whether the user's role includes role.
+func (u *User) atLeast(role string) bool {
+	return slices.Index(roles, u.Role) >= slices.Index(roles, role)
+}
+
+func (u *User) owns(group string) bool {
+	return slices.Contains(u.Groups, group)
+}
+
+func (s *Store) CreateUser(name, role string) error {
+	if !tokenNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid user name %q", name)
+	}
+	if err := validateRole(role); err != nil {
+		return err
+	}
+	var exists int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM users WHERE name = ?", name).Scan(&exists); err != nil {
+		return err
+	}
+	if exists > 0 {
+		return errUserExists
+	}
+	_, err := s.db.Exec("INSERT INTO users (name, role, created_at) VALUES (?, ?, ?)", name, role, time.Now().Unix())
+	return err
+}
+
+// DeleteUser removes the user with its group ownerships and tokens.
+func (s *Store) DeleteUser(name string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM users WHERE name = ?", name)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return errUserNotFound
+	}
+	if _, err := tx.Exec("DELETE FROM user_groups WHERE user_name = ?", name); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM api_tokens WHERE user_name = ?", name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Store) SetUserRole(name, role string) error {
+	if err := validateRole(role); err != nil {
+		return err
+	}
+	result, err := s.db.Exec("UPDATE users SET role = ? WHERE name = ?", role, name)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return errUserNotFound
+	}
+	return nil
+}
+
+// GetUser returns the user with the groups it owns.
+func (s *Store) GetUser(name string) (*User, error) {
+	users, err := s.listUsers(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, errUserNotFound
+	}
+	return &users[0], nil
+}
+
+func (s *Store) ListUsers() ([]User, error) {
+	return s.listUsers("")
+}
+
+func (s *Store) listUsers(name string) ([]User, error) {
+	query := `SELECT u.name, u.role, u.created_at, ug.group_name FROM users u
+		LEFT JOIN user_groups ug ON ug.user_name = u.name`
+	var args []any
+	if name != "" {
+		query += " WHERE u.name = ?"
+		args = append(args, name)
+	}
+	rows, err := s.db.Query(query+" ORDER BY u.name, ug.group_name", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		var u User
+		var created int64
+		var group sql.NullString
+		if err := rows.Scan(&u.Name, &u.Role, &created, &group); err != nil {
+			return nil, err
+		}
+		if len(users) == 0 || users[len(users)-1].Name != u.Name {
+			u.CreatedAt = time.Unix(created, 0)
+			u.Groups = []string{}
+			users = append(users, u)
+		}
+		if group.Valid {
+			last := &users[len(users)-1]
+			last.Groups = append(last.Groups, group.String)
+		}
+	}
+	return users, rows.Err()
+}
+
+// AddUserGroup makes the user an owner of the group; adding it twice is a
+// no-op.
+func (s *Store) AddUserGroup(user, group string) error {
+	if err := s.checkUserGroup(user, group); err != nil {
+		return err
+	}
+	_, err := s.db.Exec("INSERT OR IGNORE INTO user_groups (user_name, group_name) VALUES (?, ?)", user, group)
+	return err
+}
+
+func (s *Store) RemoveUserGroup(user, group string) error {
+	if err := s.checkUserGroup(user, group); err != nil {
+		return err
+	}
+	_, err := s.db.Exec("DELETE FROM user_groups WHERE user_name = ? AND group_name = ?", user, group)
+	return err
+}
+
+func (s *Store) checkUserGroup(user, group string) error {
+	var exists int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM users WHERE name = ?", user).Scan(&exists); err != nil {
+		return err
+	}
+	if exists == 0 {
+		return errUserNotFound
+	}
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM groups WHERE name = ?", group).Scan(&exists); err != nil {
+		return err
+	}
+	if exists == 0 {
+		return errGroupNotFound
+	}
+	return nil
+}
+
+// peerGroups returns the names of the groups the peer is in.
+func (s *Store) peerGroups(peerName string) ([]string, error) {
+	var id string
+	err := s.db.QueryRow("SELECT id FROM peers WHERE name = ?", peerName).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errPeerNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query("SELECT group_name FROM peer_groups WHERE peer_id = ? ORDER BY group_name", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var groups []string
+	for rows.Next() {
+		var g string
+		if err := rows.Scan(&g); err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	return groups, rows.Err()
+}
+
+// As returns a Manager that acts on behalf of user and refuses what its
+// role does not allow. A nil user is not restricted.
+func (m *Manager) As(user *User) *Manager {
+	scoped := *m
+	scoped.user = user
+	return &scoped
+}
+
+// require checks that the acting user has at least role.
+func (m *Manager) require(role string) error {
+	if m.user == nil || m.user.atLeast(role) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s needs the %s role", errForbidden, m.user.Name, role)
+}
+
+// requirePeer checks that the acting user may change the peer: admins may
+// change any peer, operators only peers in a group they own.
+func (m *Manager) requirePeer(name string) error {
+	if err := m.require(roleOperator); err != nil {
+		return err
+	}
+	if m.user == nil || m.user.atLeast(roleAdmin) {
+		return nil
+	}
+	groups, err := m.store.peerGroups(name)
+	if err != nil {
+		return err
+	}
+	for _, g := range groups {
+		if m.user.owns(g) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s is not in a group %s owns", errForbidden, name, m.user.Name)
+}
+
+// requireNewPeerGroup checks that the acting user may add a peer to group
+// and fills in the group for an operator that owns exactly one. Site routes
+// and mesh endpoints change what other peers route, so only admins may set
+// them.
+func (m *Manager) requireNewPeerGroup(opts *PeerOptions) error {
+	if err := m.require(roleOperator); err != nil {
+		return err
+	}
+	if m.user == nil || m.user.atLeast(roleAdmin) {
+		return nil
+	}
+	if len(opts.SiteRoutes) > 0 {
+		return fmt.Errorf("%w: %s needs the %s role to add a site", errForbidden, m.user.Name, roleAdmin)
+	}
+	if opts.Endpoint != "" {
+		return fmt.Errorf("%w: %s needs the %s role to add a mesh peer", errForbidden, m.user.Name, roleAdmin)
+	}
+	if opts.Group == "" && len(m.user.Groups) == 1 {
+		opts.Group = m.user.Groups[0]
+	}
+	if opts.Group == "" || !m.user.owns(opts.Group) {
+		return fmt.Errorf("%w: %s may only add peers to a group it owns", errForbidden, m.user.Name)
+	}
+	return nil
+}
+
+func (m *Manager) CreateUser(name, role string) error {
+	if err := m.require(roleAdmin); err != nil {
+		return err
+	}
+	return m.store.CreateUser(name, role)
+}
+
+func (m *Manager) DeleteUser(name string) error {
+	if err := m.require(roleAdmin); err != nil {
+		return err
+	}
+	return m.store.DeleteUser(name)
+}
+
+func (m *Manager) SetUserRole(name, role string) error {
+	if err := m.require(roleAdmin); err != nil {
+		return err
+	}
+	return m.store.SetUserRole(name, role)
+}
+
+func (m *Manager) AddUserGroup(user, group string) error {
+	if err := m.require(roleAdmin); err != nil {
+		return err
+	}
+	return m.store.AddUserGroup(user, group)
+}
+
+func (m *Manager) RemoveUserGroup(user, group string) error {
+	if err := m.require(roleAdmin); err != nil {
+		return err
+	}
+	return m.store.RemoveUserGroup(user, group)
+}
+
+func (m *Manager) GetUser(name string) (*User, error) {
+	return m.store.GetUser(name)
+}
+
+func (m *Manager) ListUsers() ([]User, error) {
+	return m.store.ListUsers()
+}
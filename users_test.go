@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestManagerAccess(t *testing.T) {
+	viewer := &User{Name: "auditor", Role: roleViewer}
+	operator := &User{Name: "lead", Role: roleOperator, Groups: []string{"ops"}}
+	multi := &User{Name: "multi", Role: roleOperator, Groups: []string{"dev", "ops"}}
+	admin := &User{Name: "root", Role: roleAdmin}
+
+	add := func(name string, opts PeerOptions) func(*Manager) error {
+		return func(m *Manager) error {
+			_, _, err := m.AddPeer(name, opts)
+			return err
+		}
+	}
+	remove := func(name string) func(*Manager) error {
+		return func(m *Manager) error {
+			_, err := m.RemovePeer(name)
+			return err
+		}
+	}
+	disable := func(name string) func(*Manager) error {
+		return func(m *Manager) error {
+			_, err := m.DisablePeer(name)
+			return err
+		}
+	}
+	sync := func(m *Manager) error { return m.Sync() }
+
+	tests := []struct {
+		name      string
+		user      *User
+		action    func(*Manager) error
+		forbidden bool
+	}{
+		{"viewer add", viewer, add("new", PeerOptions{Group: "ops"}), true},
+		{"viewer remove", viewer, remove("opspeer"), true},
+		{"viewer sync", viewer, sync, true},
+
+		{"operator add to own group", operator, add("new", PeerOptions{Group: "ops"}), false},
+		{"operator add to other group", operator, add("new", PeerOptions{Group: "dev"}), true},
+		{"operator remove in own group", operator, remove("opspeer"), false},
+		{"operator remove in other group", operator, remove("devpeer"), true},
+		{"operator disable in other group", operator, disable("devpeer"), true},
+		{"operator remove ungrouped", operator, remove("loose"), true},
+		{"operator disable ungrouped", operator, disable("loose"), true},
+		{"operator add site", operator, add("new", PeerOptions{Group: "ops", SiteRoutes: []string{"192.168.50.0/24"}}), true},
+		{"operator add mesh peer", operator, add("new", PeerOptions{Group: "ops", Endpoint: "new.example.com:51820"}), true},
+		{"operator sync", operator, sync, false},
+
+		{"operator with several groups adds without group", multi, add("new", PeerOptions{}), true},
+		{"operator with several groups names one", multi, add("new", PeerOptions{Group: "dev"}), false},
+
+		{"admin add ungrouped", admin, add("new", PeerOptions{}), false},
+		{"admin add site", admin, add("new", PeerOptions{SiteRoutes: []string{"192.168.50.0/24"}}), false},
+		{"admin add mesh peer", admin, add("new", PeerOptions{Endpoint: "new.example.com:51820"}), false},
+		{"admin remove ungrouped", admin, remove("loose"), false},
+		{"admin sync", admin, sync, false},
+
+		{"no user add site", nil, add("new", PeerOptions{SiteRoutes: []string{"192.168.50.0/24"}}), false},
+		{"no user remove ungrouped", nil, remove("loose"), false},
+		{"no user sync", nil, sync, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr := newAccessTestManager(t)
+			err := tt.action(mgr.As(tt.user))
+			if tt.forbidden {
+				if !errors.Is(err, errForbidden) {
+					t.Errorf("error = %v, want %v", err, errForbidden)
+				}
+			} else if err != nil {
+				t.Errorf("error = %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestOperatorAddsToOwnGroup(t *testing.T) {
+	mgr := newAccessTestManager(t)
+	operator := &User{Name: "lead", Role: roleOperator, Groups: []string{"ops"}}
+
+	if _, _, err := mgr.As(operator).AddPeer("new", PeerOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	groups, err := mgr.store.peerGroups("new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(groups, []string{"ops"}) {
+		t.Errorf("groups = %v, want [ops]", groups)
+	}
+}
+
+// newAccessTestManager returns a running manager with groups ops and dev,
+// a peer in each and the ungrouped peer loose.
+func newAccessTestManager(t *testing.T) *Manager {
+	t.Helper()
+	mgr, _ := newTestManager(t, &Config{Interface: "wg0", Address: "10.0.0.1/24"})
+	if err := mgr.Up(); err != nil {
+		t.Fatal(err)
+	}
+	for _, g := range []string{"ops", "dev"} {
+		if err := mgr.store.CreateGroup(g); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, group := range map[string]string{"opspeer": "ops", "devpeer": "dev", "loose": ""} {
+		if _, _, err := mgr.AddPeer(name, PeerOptions{Group: group}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return mgr
+}
@@ -1,61 +1,118 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"net/netip"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // generateServerConfig builds the server WireGuard config from local config
 // and enabled peers in the database. Keep the format compatible with wg-quick.
 
-func generateServerConfig(cfg *Config, peers []Peer) string {
+func generateServerConfig(cfg *Config, state State) string {
 	var sb strings.Builder
 
 	// Server interface
 	sb.WriteString("[Interface]\n")
 	sb.WriteString(fmt.Sprintf("PrivateKey = %s\n", cfg.PrivateKey))
-	sb.WriteString(fmt.Sprintf("Address = %s\n", cfg.Address))
+	sb.WriteString(fmt.Sprintf("Address = %s\n", strings.Join(cfg.Addresses(), ", ")))
 	sb.WriteString(fmt.Sprintf("ListenPort = %d\n", cfg.ListenPort))
 
-	// NAT rules - only for Linux (iptables), skip on macOS
-	if cfg.NATInterface != "" && runtime.GOOS == "linux" {
-		sb.WriteString(fmt.Sprintf("PostUp = iptables -A FORWARD -i %%i -j ACCEPT; iptables -t nat -A POSTROUTING -o %s -j MASQUERADE\n", cfg.NATInterface))
-		sb.WriteString(fmt.Sprintf("PostDown = iptables -D FORWARD -i %%i -j ACCEPT; iptables -t nat -D POSTROUTING -o %s -j MASQUERADE\n", cfg.NATInterface))
+	if up := state.Firewall.Up; len(up) > 0 {
+		sb.WriteString(fmt.Sprintf("PostUp = %s\n", strings.Join(up, "; ")))
+	}
+	if down := state.Firewall.Down; len(down) > 0 {
+		sb.WriteString(fmt.Sprintf("PostDown = %s\n", strings.Join(down, "; ")))
 	}
 
-	for _, peer := range peers {
+	for _, peer := range state.Peers {
 		sb.WriteString("\n[Peer]\n")
 		sb.WriteString(fmt.Sprintf("PublicKey = %s\n", peer.PublicKey))
-		sb.WriteString(fmt.Sprintf("AllowedIPs = %s\n", peer.AllowedIP))
+		if peer.PresharedKey != "" {
+			sb.WriteString(fmt.Sprintf("PresharedKey = %s\n", peer.PresharedKey))
+		}
+		sb.WriteString(fmt.Sprintf("AllowedIPs = %s\n", strings.Join(peer.ServerAllowedIPs(), ", ")))
 	}
 
 	return sb.String()
 }
 
-func generateClientConfig(cfg *Config, peer *Peer) string {
+// clientKeyPlaceholder stands in for the private key in configs of peers
+// that enrolled with their own public key.
+const clientKeyPlaceholder = "<client-private-key>"
+
+// generateClientConfig builds a peer's config. others are the enabled
+// peers: a site peer routes to the other sites' LANs through the hub, and a
+// mesh peer also gets every other mesh peer as a direct [Peer].
+func generateClientConfig(cfg *Config, peer *Peer, others []Peer) string {
 	var sb strings.Builder
 
 	sb.WriteString("[Interface]\n")
-	sb.WriteString(fmt.Sprintf("PrivateKey = %s\n", peer.PrivateKey))
-	sb.WriteString(fmt.Sprintf("Address = %s\n", peer.AllowedIP))
+	if peer.HasPrivateKey() {
+		sb.WriteString(fmt.Sprintf("PrivateKey = %s\n", peer.PrivateKey))
+	} else {
+		sb.WriteString(fmt.Sprintf("# Use the private key matching %s\n", peer.PublicKey))
+		sb.WriteString(fmt.Sprintf("PrivateKey = %s\n", clientKeyPlaceholder))
+	}
+	sb.WriteString(fmt.Sprintf("Address = %s\n", strings.Join(peer.AllowedIPs(), ", ")))
+	if port := peer.ListenPort(); port != "" {
+		sb.WriteString(fmt.Sprintf("ListenPort = %s\n", port))
+	}
 	if cfg.DNS != "" {
 		sb.WriteString(fmt.Sprintf("DNS = %s\n", cfg.DNS))
 	}
 
 	sb.WriteString("\n[Peer]\n")
 	sb.WriteString(fmt.Sprintf("PublicKey = %s\n", cfg.PublicKey))
+	if peer.PresharedKey != "" {
+		sb.WriteString(fmt.Sprintf("PresharedKey = %s\n", peer.PresharedKey))
+	}
 	if cfg.Endpoint != "" {
 		sb.WriteString(fmt.Sprintf("Endpoint = %s\n", cfg.Endpoint))
 	}
-	sb.WriteString("AllowedIPs = 0.0.0.0/0\n")
+	allowedIPs := clientAllowedIPs(cfg, peer)
+	if peer.IsSite() {
+		allowedIPs = siteClientAllowedIPs(cfg, peer, others)
+	}
+	sb.WriteString(fmt.Sprintf("AllowedIPs = %s\n", strings.Join(allowedIPs, ", ")))
 	sb.WriteString("PersistentKeepalive = 25\n")
 
+	if peer.IsMesh() {
+		writeMeshPeers(&sb, peer, others)
+	}
+
 	return sb.String()
 }
 
+// PeerStatus is the runtime state of a peer as reported by WireGuard.
+type PeerStatus struct {
+	PublicKey string `json:"public_key"`
+	// PresharedKey is only used to detect drift and is never serialized.
+	PresharedKey  string    `json:"-"`
+	Endpoint      string    `json:"endpoint,omitempty"`
+	AllowedIPs    []string  `json:"allowed_ips"`
+	LastHandshake time.Time `json:"last_handshake"`
+	RxBytes       int64     `json:"rx_bytes"`
+	TxBytes       int64     `json:"tx_bytes"`
+}
+
+// onlineWindow is how recent a handshake must be for a peer to count as
+// online. WireGuard re-handshakes every two minutes while traffic flows and
+// drops sessions older than three.
+const onlineWindow = 3 * time.Minute
+
+// Online reports whether the peer completed a handshake within onlineWindow.
+func (st PeerStatus) Online(now time.Time) bool {
+	return !st.LastHandshake.IsZero() && now.Sub(st.LastHandshake) < onlineWindow
+}
+
 // extractPeerConfig extracts just the [Peer] sections for wg syncconf
 func extractPeerConfig(config string) string {
 	lines := strings.Split(config, "\n")
@@ -74,11 +131,226 @@ func extractPeerConfig(config string) string {
 	return strings.Join(result, "\n")
 }
 
-func runSudo(name string, args ...string) error {
+// wgQuickBackend manages the interface by shelling out to wg-quick and wg
+// through sudo, which may prompt for a password on the terminal; see
+// sudoPrompt.
+type wgQuickBackend struct {
+	cfg *Config
+}
+
+// configPath is where the server config lives for wg-quick, which reads it
+// again on down. It holds the server private key and preshared keys in
+// plain text, even with encrypted storage.
+func (b *wgQuickBackend) configPath() string {
+	return filepath.Join(b.cfg.DataDir, b.cfg.Interface+".conf")
+}
+
+func (b *wgQuickBackend) writeConfig(state State) (string, error) {
+	wgConfig := generateServerConfig(b.cfg, state)
+	if err := os.WriteFile(b.configPath(), []byte(wgConfig), 0600); err != nil {
+		return "", fmt.Errorf("write WireGuard config: %w", err)
+	}
+	return wgConfig, nil
+}
+
+func (b *wgQuickBackend) Up(state State) error {
+	if _, err := b.writeConfig(state); err != nil {
+		return err
+	}
+	return runSudo("wg-quick", "up", b.configPath())
+}
+
+func (b *wgQuickBackend) Down() error {
+	return runSudo("wg-quick", "down", b.configPath())
+}
+
+func (b *wgQuickBackend) Apply(state State) error {
+	if b.cfg.Interface == "" {
+		return fmt.Errorf("WireGuard interface not set in config")
+	}
+
+	wgConfig, err := b.writeConfig(state)
+	if err != nil {
+		return err
+	}
+
+	if err := b.syncConf(extractPeerConfig(wgConfig)); err != nil {
+		return err
+	}
+	if err := b.syncRoutes(state); err != nil {
+		return err
+	}
+	if len(state.Firewall.Sync) == 0 {
+		return nil
+	}
+	// set -e stops at the first failing command so its error is reported
+	// rather than masked by the ones after it.
+	script := "set -e\n" + strings.ReplaceAll(strings.Join(state.Firewall.Sync, "\n"), "%i", b.cfg.Interface)
+	if err := runSudo("sh", "-c", script); err != nil {
+		return fmt.Errorf("apply firewall: %w", err)
+	}
+	return nil
+}
+
+// syncConf hands the peers to `wg syncconf` through a 0600 temp file that
+// is removed again straight after, so preshared keys don't stay on disk.
+func (b *wgQuickBackend) syncConf(peerConf string) error {
+	f, err := os.CreateTemp("", "vpn-peers-*.conf")
+	if err != nil {
+		return fmt.Errorf("write peers temp file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(peerConf)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("write peers temp file: %w", err)
+	}
+	return runSudo("wg", "syncconf", b.cfg.Interface, f.Name())
+}
+
+// syncRoutes points the site prefixes at the interface. wg-quick adds
+// routes for AllowedIPs on up, but `wg syncconf` does not, so sites added or
+// removed while the interface runs are fixed up here; see staleRoutes for
+// what is removed. macOS only gets new routes on the next up.
+func (b *wgQuickBackend) syncRoutes(state State) error {
+	if runtime.GOOS != "linux" {
+		return nil
+	}
+	desired := siteRoutes(state.Peers)
+	current, err := b.interfaceRoutes()
+	if err != nil {
+		return err
+	}
+	for _, prefix := range desired {
+		if err := runSudo("ip", ipFamilyFlag(prefix), "route", "replace", prefix.String(), "dev", b.cfg.Interface); err != nil {
+			return fmt.Errorf("add route %s: %w", prefix, err)
+		}
+	}
+	for _, prefix := range staleRoutes(current, desired, state.AppliedRoutes) {
+		if err := runSudo("ip", ipFamilyFlag(prefix), "route", "del", prefix.String(), "dev", b.cfg.Interface); err != nil {
+			return fmt.Errorf("remove route %s: %w", prefix, err)
+		}
+	}
+	return nil
+}
+
+// interfaceRoutes lists the destinations routed to the interface in the
+// main table, leaving out those the kernel made for its addresses.
+func (b *wgQuickBackend) interfaceRoutes() ([]netip.Prefix, error) {
+	var routes []netip.Prefix
+	for _, family := range []string{"-4", "-6"} {
+		out, err := exec.Command("ip", family, "-o", "route", "show", "dev", b.cfg.Interface).Output()
+		if err != nil {
+			return nil, fmt.Errorf("list routes: %w", err)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 0 || fields[0] == "default" || strings.Contains(line, "proto kernel") {
+				continue
+			}
+			if prefix, err := netip.ParsePrefix(fields[0]); err == nil {
+				routes = append(routes, prefix)
+			} else if addr, err := netip.ParseAddr(fields[0]); err == nil {
+				routes = append(routes, netip.PrefixFrom(addr, addr.BitLen()))
+			}
+		}
+	}
+	return routes, nil
+}
+
+func ipFamilyFlag(prefix netip.Prefix) string {
+	if prefix.Addr().Is6() {
+		return "-6"
+	}
+	return "-4"
+}
+
+func (b *wgQuickBackend) Status() ([]PeerStatus, error) {
+	cmd, stderr := sudoCommand("wg", "show", b.cfg.Interface, "dump")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("wg show: %w", sudoError(err, stderr))
+	}
+	return parseWGDump(string(out))
+}
+
+// parseWGDump parses `wg show <iface> dump`. The first line describes the
+// interface; each following line is a tab-separated peer: public key,
+// preshared key, endpoint, allowed ips, latest handshake, rx, tx, keepalive.
+func parseWGDump(dump string) ([]PeerStatus, error) {
+	lines := strings.Split(strings.TrimSpace(dump), "\n")
+	var peers []PeerStatus
+	for _, line := range lines[1:] {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 8 {
+			return nil, fmt.Errorf("unexpected wg dump line: %q", line)
+		}
+
+		st := PeerStatus{PublicKey: fields[0]}
+		if fields[1] != "(none)" {
+			st.PresharedKey = fields[1]
+		}
+		if fields[2] != "(none)" {
+			st.Endpoint = fields[2]
+		}
+		if fields[3] != "(none)" {
+			st.AllowedIPs = strings.Split(fields[3], ",")
+		}
+		handshake, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parse handshake: %w", err)
+		}
+		if handshake > 0 {
+			st.LastHandshake = time.Unix(handshake, 0)
+		}
+		if st.RxBytes, err = strconv.ParseInt(fields[5], 10, 64); err != nil {
+			return nil, fmt.Errorf("parse rx bytes: %w", err)
+		}
+		if st.TxBytes, err = strconv.ParseInt(fields[6], 10, 64); err != nil {
+			return nil, fmt.Errorf("parse tx bytes: %w", err)
+		}
+		peers = append(peers, st)
+	}
+	return peers, nil
+}
+
+// sudoPrompt reports whether sudo may ask for a password on the terminal.
+// Commands that run unattended, such as the API server, turn it off: sudo
+// then runs with -n and fails at once instead of blocking on a prompt
+// nobody sees.
+var sudoPrompt = stdinIsTerminal()
+
+// sudoCommand builds a sudo command for name. Without a prompt its stderr
+// is captured in the returned buffer for sudoError.
+func sudoCommand(name string, args ...string) (*exec.Cmd, *bytes.Buffer) {
 	allArgs := append([]string{name}, args...)
+	if !sudoPrompt {
+		cmd := exec.Command("sudo", append([]string{"-n"}, allArgs...)...)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		return cmd, &stderr
+	}
 	cmd := exec.Command("sudo", allArgs...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
 	cmd.Stdin = os.Stdin
-	return cmd.Run()
+	cmd.Stderr = os.Stderr
+	return cmd, nil
+}
+
+// sudoError adds what sudo or the command printed, if it was captured, to
+// err.
+func sudoError(err error, stderr *bytes.Buffer) error {
+	if err != nil && stderr != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%w: %s", err, msg)
+		}
+	}
+	return err
+}
+
+func runSudo(name string, args ...string) error {
+	cmd, stderr := sudoCommand(name, args...)
+	cmd.Stdout = os.Stdout
+	return sudoError(cmd.Run(), stderr)
 }
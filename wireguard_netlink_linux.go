@@ -0,0 +1,630 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os/exec"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Native WireGuard configuration over netlink, used when Config.Backend is
+// "netlink". Attribute numbers mirror include/uapi/linux/wireguard.h.
+
+const (
+	wgGenlName    = "wireguard"
+	wgGenlVersion = 1
+	wgMTU         = 1420
+	// wgPeersPerMessage keeps SET_DEVICE requests well below the socket
+	// buffer size on servers with many peers.
+	wgPeersPerMessage = 128
+
+	wgCmdGetDevice = 0
+	wgCmdSetDevice = 1
+
+	wgDeviceAIfname     = 2
+	wgDeviceAPrivateKey = 3
+	wgDeviceAFlags      = 5
+	wgDeviceAListenPort = 6
+	wgDeviceAPeers      = 8
+	wgDeviceFReplace    = 1
+
+	wgPeerAPublicKey     = 1
+	wgPeerAPresharedKey  = 2
+	wgPeerAFlags         = 3
+	wgPeerAEndpoint      = 4
+	wgPeerALastHandshake = 6
+	wgPeerARxBytes       = 7
+	wgPeerATxBytes       = 8
+	wgPeerAAllowedIPs    = 9
+	wgPeerFRemoveMe      = 1
+	wgPeerFReplaceIPs    = 2
+
+	wgAllowedIPAFamily = 1
+	wgAllowedIPAIPAddr = 2
+	wgAllowedIPACIDR   = 3
+
+	iflaInfoKind = 1
+
+	rtTableMain   = 254
+	rtProtoKernel = 2
+	rtProtoStatic = 4
+	rtScopeLink   = 253
+	rtnUnicast    = 1
+)
+
+// wgPeerSpec is one peer entry of a SET_DEVICE request.
+type wgPeerSpec struct {
+	PublicKey []byte
+	// PresharedKey is all zeroes when the peer has none, which also clears
+	// a key set earlier.
+	PresharedKey []byte
+	AllowedIPs   []netip.Prefix
+	Remove       bool
+}
+
+// netlinkBackend configures the kernel directly over netlink. It is expected
+// to run as root, e.g. from a service.
+type netlinkBackend struct {
+	cfg *Config
+}
+
+func newNetlinkBackend(cfg *Config) (Backend, error) {
+	return &netlinkBackend{cfg: cfg}, nil
+}
+
+// Up creates the interface, configures keys and peers, assigns the server
+// addresses and brings the link up. A half-configured interface is removed
+// again on failure.
+func (b *netlinkBackend) Up(state State) (err error) {
+	cfg := b.cfg
+	privKey, err := decodeKey(cfg.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("server private key: %w", err)
+	}
+	specs, err := peerSpecs(state.Peers)
+	if err != nil {
+		return err
+	}
+	var addrs []netip.Prefix
+	for _, a := range cfg.Addresses() {
+		prefix, err := netip.ParsePrefix(a)
+		if err != nil {
+			return fmt.Errorf("parse address %s: %w", a, err)
+		}
+		addrs = append(addrs, prefix)
+	}
+
+	rt, err := dialNetlink(syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer rt.Close()
+
+	if err := createLink(rt, cfg.Interface); err != nil {
+		if errors.Is(err, syscall.EOPNOTSUPP) {
+			return fmt.Errorf("%w (is the wireguard kernel module loaded?)", err)
+		}
+		return err
+	}
+	iface, err := net.InterfaceByName(cfg.Interface)
+	if err != nil {
+		return fmt.Errorf("find interface %s: %w", cfg.Interface, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = deleteLink(rt, iface.Index)
+		}
+	}()
+
+	gc, family, err := dialWireGuard()
+	if err != nil {
+		return err
+	}
+	defer gc.Close()
+
+	if err := setDevice(gc, family, cfg.Interface, privKey, cfg.ListenPort, specs); err != nil {
+		return err
+	}
+	for _, prefix := range addrs {
+		if err := addAddress(rt, iface.Index, prefix); err != nil {
+			return err
+		}
+	}
+	if err := setLinkUp(rt, iface.Index, wgMTU); err != nil {
+		return err
+	}
+	for _, prefix := range siteRoutes(state.Peers) {
+		if err := replaceRoute(rt, iface.Index, prefix); err != nil {
+			return err
+		}
+	}
+
+	return runHooks(state.Firewall.Up, cfg.Interface)
+}
+
+// Down removes the firewall and NAT rules and deletes the interface.
+func (b *netlinkBackend) Down() error {
+	cfg := b.cfg
+	iface, err := net.InterfaceByName(cfg.Interface)
+	if err != nil {
+		return fmt.Errorf("find interface %s: %w", cfg.Interface, err)
+	}
+
+	hookErr := runHooks(firewallTeardown(cfg), cfg.Interface)
+
+	rt, err := dialNetlink(syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer rt.Close()
+
+	if err := deleteLink(rt, iface.Index); err != nil {
+		return err
+	}
+	return hookErr
+}
+
+// ApplyPeers brings the running peer set in line with peers, like
+// `wg syncconf`: unknown peers are removed and existing peers keep their
+// endpoint and session while their AllowedIPs are replaced.
+func (b *netlinkBackend) Apply(state State) error {
+	cfg := b.cfg
+	specs, err := peerSpecs(state.Peers)
+	if err != nil {
+		return err
+	}
+
+	gc, family, err := dialWireGuard()
+	if err != nil {
+		return err
+	}
+	defer gc.Close()
+
+	current, err := getDevicePeers(gc, family, cfg.Interface)
+	if err != nil {
+		return err
+	}
+	desired := make(map[string]bool, len(state.Peers))
+	for _, p := range state.Peers {
+		desired[p.PublicKey] = true
+	}
+	for _, p := range current {
+		if desired[p.PublicKey] {
+			continue
+		}
+		key, err := decodeKey(p.PublicKey)
+		if err != nil {
+			return err
+		}
+		specs = append(specs, wgPeerSpec{PublicKey: key, Remove: true})
+	}
+
+	if err := setDevice(gc, family, cfg.Interface, nil, 0, specs); err != nil {
+		return err
+	}
+	if err := b.syncRoutes(state); err != nil {
+		return err
+	}
+	return runHooks(state.Firewall.Sync, cfg.Interface)
+}
+
+// syncRoutes points the site prefixes at the interface and removes routes
+// of sites that are gone; see staleRoutes.
+func (b *netlinkBackend) syncRoutes(state State) error {
+	iface, err := net.InterfaceByName(b.cfg.Interface)
+	if err != nil {
+		return fmt.Errorf("find interface %s: %w", b.cfg.Interface, err)
+	}
+	rt, err := dialNetlink(syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer rt.Close()
+
+	desired := siteRoutes(state.Peers)
+	current, err := listRoutes(rt, iface.Index)
+	if err != nil {
+		return err
+	}
+	for _, prefix := range desired {
+		if err := replaceRoute(rt, iface.Index, prefix); err != nil {
+			return err
+		}
+	}
+	for _, prefix := range staleRoutes(current, desired, state.AppliedRoutes) {
+		if err := deleteRoute(rt, iface.Index, prefix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Status reads the live peer state of the interface.
+func (b *netlinkBackend) Status() ([]PeerStatus, error) {
+	gc, family, err := dialWireGuard()
+	if err != nil {
+		return nil, err
+	}
+	defer gc.Close()
+
+	return getDevicePeers(gc, family, b.cfg.Interface)
+}
+
+func dialWireGuard() (*nlConn, uint16, error) {
+	gc, err := dialNetlink(syscall.NETLINK_GENERIC)
+	if err != nil {
+		return nil, 0, err
+	}
+	family, err := genlFamily(gc, wgGenlName)
+	if err != nil {
+		gc.Close()
+		return nil, 0, fmt.Errorf("%w (is the wireguard kernel module loaded?)", err)
+	}
+	return gc, family, nil
+}
+
+func peerSpecs(peers []Peer) ([]wgPeerSpec, error) {
+	specs := make([]wgPeerSpec, 0, len(peers))
+	for _, p := range peers {
+		key, err := decodeKey(p.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("peer %s: %w", p.PublicKey, err)
+		}
+		spec := wgPeerSpec{PublicKey: key, PresharedKey: make([]byte, 32)}
+		if p.PresharedKey != "" {
+			if spec.PresharedKey, err = decodeKey(p.PresharedKey); err != nil {
+				return nil, fmt.Errorf("peer %s preshared key: %w", p.PublicKey, err)
+			}
+		}
+		for _, ip := range p.ServerAllowedIPs() {
+			prefix, err := netip.ParsePrefix(ip)
+			if err != nil {
+				return nil, fmt.Errorf("peer %s: %w", p.PublicKey, err)
+			}
+			spec.AllowedIPs = append(spec.AllowedIPs, prefix.Masked())
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+func decodeKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("decode key: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("decode key: want 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
+// setDevice sends WG_CMD_SET_DEVICE, split across several messages when there
+// are many peers. A non-nil privKey marks a fresh device: the key and port
+// are set and any existing peers are replaced.
+func setDevice(c *nlConn, family uint16, name string, privKey []byte, port int, specs []wgPeerSpec) error {
+	first := true
+	for first || len(specs) > 0 {
+		batch := specs[:min(len(specs), wgPeersPerMessage)]
+		specs = specs[len(batch):]
+
+		var attrs nlAttrs
+		attrs.str(wgDeviceAIfname, name)
+		if first && privKey != nil {
+			attrs.bytes(wgDeviceAPrivateKey, privKey)
+			attrs.u16(wgDeviceAListenPort, uint16(port))
+			attrs.u32(wgDeviceAFlags, wgDeviceFReplace)
+		}
+		first = false
+
+		if len(batch) > 0 {
+			attrs.nested(wgDeviceAPeers, func(a *nlAttrs) {
+				for i, spec := range batch {
+					a.nested(uint16(i), func(a *nlAttrs) { encodePeerSpec(a, spec) })
+				}
+			})
+		}
+
+		body := append([]byte{wgCmdSetDevice, wgGenlVersion, 0, 0}, attrs.b...)
+		if _, err := c.execute("set device "+name, family, 0, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodePeerSpec(a *nlAttrs, spec wgPeerSpec) {
+	a.bytes(wgPeerAPublicKey, spec.PublicKey)
+	if spec.Remove {
+		a.u32(wgPeerAFlags, wgPeerFRemoveMe)
+		return
+	}
+	a.u32(wgPeerAFlags, wgPeerFReplaceIPs)
+	a.bytes(wgPeerAPresharedKey, spec.PresharedKey)
+	a.nested(wgPeerAAllowedIPs, func(a *nlAttrs) {
+		for i, prefix := range spec.AllowedIPs {
+			a.nested(uint16(i), func(a *nlAttrs) {
+				if prefix.Addr().Is4() {
+					a.u16(wgAllowedIPAFamily, syscall.AF_INET)
+				} else {
+					a.u16(wgAllowedIPAFamily, syscall.AF_INET6)
+				}
+				a.bytes(wgAllowedIPAIPAddr, prefix.Addr().AsSlice())
+				a.u8(wgAllowedIPACIDR, uint8(prefix.Bits()))
+			})
+		}
+	})
+}
+
+// getDevicePeers dumps the device and merges peers that the kernel split
+// across several messages.
+func getDevicePeers(c *nlConn, family uint16, name string) ([]PeerStatus, error) {
+	var attrs nlAttrs
+	attrs.str(wgDeviceAIfname, name)
+	body := append([]byte{wgCmdGetDevice, wgGenlVersion, 0, 0}, attrs.b...)
+
+	replies, err := c.execute("get device "+name, family, syscall.NLM_F_DUMP, body)
+	if err != nil {
+		return nil, err
+	}
+
+	var peers []PeerStatus
+	index := make(map[string]int)
+	for _, reply := range replies {
+		if len(reply) < genlHdrLen {
+			continue
+		}
+		devAttrs, err := parseAttrs(reply[genlHdrLen:])
+		if err != nil {
+			return nil, err
+		}
+		for _, da := range devAttrs {
+			if da.Type != wgDeviceAPeers {
+				continue
+			}
+			entries, err := parseAttrs(da.Data)
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range entries {
+				p, err := parsePeer(entry.Data)
+				if err != nil {
+					return nil, err
+				}
+				if i, ok := index[p.PublicKey]; ok {
+					peers[i].AllowedIPs = append(peers[i].AllowedIPs, p.AllowedIPs...)
+					continue
+				}
+				index[p.PublicKey] = len(peers)
+				peers = append(peers, p)
+			}
+		}
+	}
+	return peers, nil
+}
+
+func parsePeer(b []byte) (PeerStatus, error) {
+	var p PeerStatus
+	attrs, err := parseAttrs(b)
+	if err != nil {
+		return p, err
+	}
+	for _, attr := range attrs {
+		switch attr.Type {
+		case wgPeerAPublicKey:
+			p.PublicKey = base64.StdEncoding.EncodeToString(attr.Data)
+		case wgPeerAPresharedKey:
+			if slices.ContainsFunc(attr.Data, func(b byte) bool { return b != 0 }) {
+				p.PresharedKey = base64.StdEncoding.EncodeToString(attr.Data)
+			}
+		case wgPeerAEndpoint:
+			p.Endpoint = parseSockaddr(attr.Data)
+		case wgPeerALastHandshake:
+			if len(attr.Data) >= 16 {
+				sec := int64(binary.NativeEndian.Uint64(attr.Data[0:8]))
+				nsec := int64(binary.NativeEndian.Uint64(attr.Data[8:16]))
+				if sec != 0 || nsec != 0 {
+					p.LastHandshake = time.Unix(sec, nsec)
+				}
+			}
+		case wgPeerARxBytes:
+			if len(attr.Data) >= 8 {
+				p.RxBytes = int64(binary.NativeEndian.Uint64(attr.Data))
+			}
+		case wgPeerATxBytes:
+			if len(attr.Data) >= 8 {
+				p.TxBytes = int64(binary.NativeEndian.Uint64(attr.Data))
+			}
+		case wgPeerAAllowedIPs:
+			entries, err := parseAttrs(attr.Data)
+			if err != nil {
+				return p, err
+			}
+			for _, entry := range entries {
+				if prefix, ok := parseAllowedIP(entry.Data); ok {
+					p.AllowedIPs = append(p.AllowedIPs, prefix.String())
+				}
+			}
+		}
+	}
+	return p, nil
+}
+
+func parseAllowedIP(b []byte) (netip.Prefix, bool) {
+	attrs, err := parseAttrs(b)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	var addr netip.Addr
+	bits := -1
+	for _, attr := range attrs {
+		switch attr.Type {
+		case wgAllowedIPAIPAddr:
+			addr, _ = netip.AddrFromSlice(attr.Data)
+		case wgAllowedIPACIDR:
+			if len(attr.Data) >= 1 {
+				bits = int(attr.Data[0])
+			}
+		}
+	}
+	if !addr.IsValid() || bits < 0 {
+		return netip.Prefix{}, false
+	}
+	return netip.PrefixFrom(addr, bits), true
+}
+
+// parseSockaddr decodes the sockaddr_in/sockaddr_in6 the kernel reports as a
+// peer endpoint. The port is in network byte order.
+func parseSockaddr(b []byte) string {
+	if len(b) < 4 {
+		return ""
+	}
+	port := binary.BigEndian.Uint16(b[2:4])
+	switch binary.NativeEndian.Uint16(b[0:2]) {
+	case syscall.AF_INET:
+		if len(b) >= 8 {
+			return netip.AddrPortFrom(netip.AddrFrom4([4]byte(b[4:8])), port).String()
+		}
+	case syscall.AF_INET6:
+		if len(b) >= 24 {
+			return netip.AddrPortFrom(netip.AddrFrom16([16]byte(b[8:24])), port).String()
+		}
+	}
+	return ""
+}
+
+func ifInfoMsg(index int, flags, change uint32) []byte {
+	b := make([]byte, syscall.SizeofIfInfomsg)
+	binary.NativeEndian.PutUint32(b[4:8], uint32(index))
+	binary.NativeEndian.PutUint32(b[8:12], flags)
+	binary.NativeEndian.PutUint32(b[12:16], change)
+	return b
+}
+
+func createLink(c *nlConn, name string) error {
+	var attrs nlAttrs
+	attrs.str(syscall.IFLA_IFNAME, name)
+	attrs.nested(syscall.IFLA_LINKINFO, func(a *nlAttrs) {
+		a.str(iflaInfoKind, wgGenlName)
+	})
+	body := append(ifInfoMsg(0, 0, 0), attrs.b...)
+	_, err := c.execute("create link "+name, syscall.RTM_NEWLINK, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, body)
+	return err
+}
+
+func setLinkUp(c *nlConn, index, mtu int) error {
+	var attrs nlAttrs
+	attrs.u32(syscall.IFLA_MTU, uint32(mtu))
+	body := append(ifInfoMsg(index, syscall.IFF_UP, syscall.IFF_UP), attrs.b...)
+	_, err := c.execute("set link up", syscall.RTM_NEWLINK, 0, body)
+	return err
+}
+
+func deleteLink(c *nlConn, index int) error {
+	_, err := c.execute("delete link", syscall.RTM_DELLINK, 0, ifInfoMsg(index, 0, 0))
+	return err
+}
+
+func addAddress(c *nlConn, index int, prefix netip.Prefix) error {
+	family := byte(syscall.AF_INET)
+	if prefix.Addr().Is6() {
+		family = syscall.AF_INET6
+	}
+	msg := make([]byte, syscall.SizeofIfAddrmsg)
+	msg[0] = family
+	msg[1] = byte(prefix.Bits())
+	binary.NativeEndian.PutUint32(msg[4:8], uint32(index))
+
+	var attrs nlAttrs
+	attrs.bytes(syscall.IFA_LOCAL, prefix.Addr().AsSlice())
+	attrs.bytes(syscall.IFA_ADDRESS, prefix.Addr().AsSlice())
+	body := append(msg, attrs.b...)
+	_, err := c.execute("add address "+prefix.String(), syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE, body)
+	return err
+}
+
+// rtMsg builds a struct rtmsg for a main-table unicast route to prefix.
+func rtMsg(prefix netip.Prefix) []byte {
+	family := byte(syscall.AF_INET)
+	if prefix.Addr().Is6() {
+		family = syscall.AF_INET6
+	}
+	return []byte{family, byte(prefix.Bits()), 0, 0, rtTableMain, rtProtoStatic, rtScopeLink, rtnUnicast, 0, 0, 0, 0}
+}
+
+func replaceRoute(c *nlConn, index int, prefix netip.Prefix) error {
+	var attrs nlAttrs
+	attrs.bytes(syscall.RTA_DST, prefix.Addr().AsSlice())
+	attrs.u32(syscall.RTA_OIF, uint32(index))
+	body := append(rtMsg(prefix), attrs.b...)
+	_, err := c.execute("add route "+prefix.String(), syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE, body)
+	return err
+}
+
+func deleteRoute(c *nlConn, index int, prefix netip.Prefix) error {
+	var attrs nlAttrs
+	attrs.bytes(syscall.RTA_DST, prefix.Addr().AsSlice())
+	attrs.u32(syscall.RTA_OIF, uint32(index))
+	body := append(rtMsg(prefix), attrs.b...)
+	_, err := c.execute("delete route "+prefix.String(), syscall.RTM_DELROUTE, 0, body)
+	return err
+}
+
+// listRoutes returns the destinations of the main-table unicast routes
+// through the interface, leaving out those the kernel made for its
+// addresses.
+func listRoutes(c *nlConn, index int) ([]netip.Prefix, error) {
+	var routes []netip.Prefix
+	for _, family := range []byte{syscall.AF_INET, syscall.AF_INET6} {
+		replies, err := c.execute("list routes", syscall.RTM_GETROUTE, syscall.NLM_F_DUMP, []byte{family, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+		if err != nil {
+			return nil, err
+		}
+		for _, reply := range replies {
+			if len(reply) < syscall.SizeofRtMsg || reply[4] != rtTableMain || reply[5] == rtProtoKernel || reply[7] != rtnUnicast {
+				continue
+			}
+			attrs, err := parseAttrs(reply[syscall.SizeofRtMsg:])
+			if err != nil {
+				return nil, err
+			}
+			var dst []byte
+			oif := -1
+			for _, a := range attrs {
+				switch a.Type {
+				case syscall.RTA_DST:
+					dst = a.Data
+				case syscall.RTA_OIF:
+					if len(a.Data) >= 4 {
+						oif = int(binary.NativeEndian.Uint32(a.Data))
+					}
+				}
+			}
+			addr, ok := netip.AddrFromSlice(dst)
+			if oif != index || !ok {
+				continue
+			}
+			routes = append(routes, netip.PrefixFrom(addr, int(reply[1])))
+		}
+	}
+	return routes, nil
+}
+
+// runHooks runs PostUp/PostDown style commands directly; the native backend
+// is expected to run as root, so there is no sudo here.
+func runHooks(cmds []string, iface string) error {
+	for _, c := range cmds {
+		c = strings.ReplaceAll(c, "%i", iface)
+		if out, err := exec.Command("sh", "-c", c).CombinedOutput(); err != nil {
+			return fmt.Errorf("%s: %w: %s", c, err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
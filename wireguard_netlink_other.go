@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"runtime"
+)
+
+func newNetlinkBackend(cfg *Config) (Backend, error) {
+	return nil, errors.New("netlink backend is not supported on " + runtime.GOOS)
+}